@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	proxy "github.com/k8spin/prometheus-multi-tenant-proxy/internal/app/prometheus-multi-tenant-proxy"
 	"github.com/urfave/cli/v2"
@@ -34,11 +35,178 @@ func main() {
 					Usage:   "Port to expose this prometheus proxy",
 					Value:   9092,
 					EnvVars: []string{envPrefix + "PORT"},
+				}, &cli.StringFlag{
+					Name:    "tls-cert-file",
+					Usage:   "Path of the TLS certificate served by the proxy, reloaded when modified. Plain HTTP if empty",
+					EnvVars: []string{envPrefix + "TLS_CERT_FILE"},
+				}, &cli.StringFlag{
+					Name:    "tls-key-file",
+					Usage:   "Path of the key of the TLS certificate, reloaded when modified",
+					EnvVars: []string{envPrefix + "TLS_KEY_FILE"},
+				}, &cli.StringFlag{
+					Name:    "tls-min-version",
+					Usage:   "Minimum TLS version accepted, one of: 1.0, 1.1, 1.2, 1.3",
+					Value:   "1.2",
+					EnvVars: []string{envPrefix + "TLS_MIN_VERSION"},
+				}, &cli.StringSliceFlag{
+					Name:    "tls-cipher-suites",
+					Usage:   "Comma separated list of the TLS cipher suites accepted, by IANA name. Go defaults if empty",
+					EnvVars: []string{envPrefix + "TLS_CIPHER_SUITES"},
+				}, &cli.DurationFlag{
+					Name:    "read-timeout",
+					Usage:   "Maximum duration to read a request, including its body. No timeout if 0",
+					Value:   time.Minute,
+					EnvVars: []string{envPrefix + "READ_TIMEOUT"},
+				}, &cli.DurationFlag{
+					Name:    "read-header-timeout",
+					Usage:   "Maximum duration to read the headers of a request. No timeout if 0",
+					Value:   10 * time.Second,
+					EnvVars: []string{envPrefix + "READ_HEADER_TIMEOUT"},
+				}, &cli.DurationFlag{
+					Name:    "write-timeout",
+					Usage:   "Maximum duration to serve a request once its headers are read, including the query. No timeout if 0",
+					Value:   5 * time.Minute,
+					EnvVars: []string{envPrefix + "WRITE_TIMEOUT"},
+				}, &cli.DurationFlag{
+					Name:    "idle-timeout",
+					Usage:   "Maximum duration to wait for the next request on a keep-alive connection. No timeout if 0",
+					Value:   2 * time.Minute,
+					EnvVars: []string{envPrefix + "IDLE_TIMEOUT"},
+				}, &cli.IntFlag{
+					Name:    "max-header-bytes",
+					Usage:   "Maximum size in bytes of the headers of a request",
+					Value:   1 << 20,
+					EnvVars: []string{envPrefix + "MAX_HEADER_BYTES"},
+				}, &cli.DurationFlag{
+					Name:    "shutdown-timeout",
+					Usage:   "Maximum duration to wait for the in-flight requests to complete on shutdown",
+					Value:   30 * time.Second,
+					EnvVars: []string{envPrefix + "SHUTDOWN_TIMEOUT"},
+				}, &cli.DurationFlag{
+					Name:    "shutdown-delay",
+					Usage:   "Duration the readiness endpoint fails before draining the requests on shutdown",
+					EnvVars: []string{envPrefix + "SHUTDOWN_DELAY"},
+				}, &cli.DurationFlag{
+					Name:    "readiness-max-config-age",
+					Usage:   "Maximum time since the auth configuration, e.g. the JWKS, was last loaded before the proxy is not ready. No limit if 0",
+					EnvVars: []string{envPrefix + "READINESS_MAX_CONFIG_AGE"},
+				}, &cli.BoolFlag{
+					Name:    "readiness-check-upstream",
+					Usage:   "If true, the proxy is not ready unless the /-/ready endpoint of Prometheus succeeds",
+					EnvVars: []string{envPrefix + "READINESS_CHECK_UPSTREAM"},
+				}, &cli.StringFlag{
+					Name:    "metrics-listen-address",
+					Usage:   "Address serving the metrics of the proxy at /metrics, e.g. :9093. Disabled if empty",
+					EnvVars: []string{envPrefix + "METRICS_LISTEN_ADDRESS"},
+				}, &cli.StringFlag{
+					Name:    "log-format",
+					Usage:   "Format of the logs: logfmt or json",
+					Value:   "logfmt",
+					EnvVars: []string{envPrefix + "LOG_FORMAT"},
+				}, &cli.StringFlag{
+					Name:    "log-level",
+					Usage:   "Minimum level of the logs: debug, info, warn or error",
+					Value:   "info",
+					EnvVars: []string{envPrefix + "LOG_LEVEL"},
+				}, &cli.StringSliceFlag{
+					Name:    "redact-query-params",
+					Usage:   "Query parameters whose values are redacted from the logs",
+					Value:   cli.NewStringSlice(proxy.DefaultRedactedParams...),
+					EnvVars: []string{envPrefix + "REDACT_QUERY_PARAMS"},
+				}, &cli.StringFlag{
+					Name:    "otlp-endpoint",
+					Usage:   "OTLP/HTTP endpoint the traces are exported to, e.g. http://localhost:4318. Disabled if empty",
+					EnvVars: []string{envPrefix + "OTLP_ENDPOINT"},
+				}, &cli.Float64Flag{
+					Name:    "trace-sample-ratio",
+					Usage:   "Ratio of the traces exported, unless sampled by the client",
+					Value:   1,
+					EnvVars: []string{envPrefix + "TRACE_SAMPLE_RATIO"},
+				}, &cli.StringFlag{
+					Name:    "audit-log",
+					Usage:   "Path of the audit log file, - for the standard output. Disabled if empty",
+					EnvVars: []string{envPrefix + "AUDIT_LOG"},
+				}, &cli.IntFlag{
+					Name:    "audit-log-max-size",
+					Usage:   "Size in megabytes of the audit log file before it is rotated",
+					Value:   100,
+					EnvVars: []string{envPrefix + "AUDIT_LOG_MAX_SIZE"},
+				}, &cli.IntFlag{
+					Name:    "audit-log-max-backups",
+					Usage:   "Number of rotated audit log files to keep, all of them if 0",
+					Value:   10,
+					EnvVars: []string{envPrefix + "AUDIT_LOG_MAX_BACKUPS"},
+				}, &cli.IntFlag{
+					Name:    "audit-log-max-age",
+					Usage:   "Number of days to keep the rotated audit log files, forever if 0",
+					EnvVars: []string{envPrefix + "AUDIT_LOG_MAX_AGE"},
 				}, &cli.StringFlag{
 					Name:    "prometheus-endpoint",
 					Usage:   "Prometheus server endpoint",
 					Value:   "http://localhost:9091",
 					EnvVars: []string{envPrefix + "PROMETHEUS_ENDPOINT"},
+				}, &cli.StringFlag{
+					Name:    "upstream-ca-file",
+					Usage:   "Path of the CA bundle verifying the certificate of Prometheus. System roots if empty",
+					EnvVars: []string{envPrefix + "UPSTREAM_CA_FILE"},
+				}, &cli.StringFlag{
+					Name:    "upstream-cert-file",
+					Usage:   "Path of the client certificate sent to Prometheus, reloaded when modified",
+					EnvVars: []string{envPrefix + "UPSTREAM_CERT_FILE"},
+				}, &cli.StringFlag{
+					Name:    "upstream-key-file",
+					Usage:   "Path of the key of the client certificate sent to Prometheus, reloaded when modified",
+					EnvVars: []string{envPrefix + "UPSTREAM_KEY_FILE"},
+				}, &cli.StringFlag{
+					Name:    "upstream-server-name",
+					Usage:   "Name verified in the certificate of Prometheus. Host of prometheus-endpoint if empty",
+					EnvVars: []string{envPrefix + "UPSTREAM_SERVER_NAME"},
+				}, &cli.BoolFlag{
+					Name:    "upstream-insecure-skip-verify",
+					Usage:   "Do not verify the certificate of Prometheus. Insecure",
+					EnvVars: []string{envPrefix + "UPSTREAM_INSECURE_SKIP_VERIFY"},
+				}, &cli.IntFlag{
+					Name:    "upstream-max-idle-conns",
+					Usage:   "Maximum number of idle connections to Prometheus",
+					Value:   100,
+					EnvVars: []string{envPrefix + "UPSTREAM_MAX_IDLE_CONNS"},
+				}, &cli.IntFlag{
+					Name:    "upstream-max-idle-conns-per-host",
+					Usage:   "Maximum number of idle connections to every Prometheus host",
+					Value:   100,
+					EnvVars: []string{envPrefix + "UPSTREAM_MAX_IDLE_CONNS_PER_HOST"},
+				}, &cli.IntFlag{
+					Name:    "upstream-max-conns-per-host",
+					Usage:   "Maximum number of connections to every Prometheus host. Unlimited if 0",
+					EnvVars: []string{envPrefix + "UPSTREAM_MAX_CONNS_PER_HOST"},
+				}, &cli.DurationFlag{
+					Name:    "upstream-idle-conn-timeout",
+					Usage:   "Duration an idle connection to Prometheus is kept",
+					Value:   90 * time.Second,
+					EnvVars: []string{envPrefix + "UPSTREAM_IDLE_CONN_TIMEOUT"},
+				}, &cli.DurationFlag{
+					Name:    "upstream-dial-timeout",
+					Usage:   "Maximum duration to connect to Prometheus",
+					Value:   30 * time.Second,
+					EnvVars: []string{envPrefix + "UPSTREAM_DIAL_TIMEOUT"},
+				}, &cli.DurationFlag{
+					Name:    "upstream-tls-handshake-timeout",
+					Usage:   "Maximum duration of the TLS handshake with Prometheus",
+					Value:   10 * time.Second,
+					EnvVars: []string{envPrefix + "UPSTREAM_TLS_HANDSHAKE_TIMEOUT"},
+				}, &cli.DurationFlag{
+					Name:    "upstream-response-header-timeout",
+					Usage:   "Maximum duration to wait for the response headers of Prometheus, i.e. for the query. No timeout if 0",
+					EnvVars: []string{envPrefix + "UPSTREAM_RESPONSE_HEADER_TIMEOUT"},
+				}, &cli.StringFlag{
+					Name:    "tenant-label",
+					Usage:   "Label of the Prometheus series holding the namespace of the tenant",
+					Value:   "namespace",
+					EnvVars: []string{envPrefix + "TENANT_LABEL"},
+				}, &cli.StringFlag{
+					Name:    "route-prefix",
+					Usage:   "Path prefix of the requests, removed before matching the protected and unprotected endpoints",
+					EnvVars: []string{envPrefix + "ROUTE_PREFIX"},
 				}, &cli.StringSliceFlag{
 					Name:    "unprotected-endpoints",
 					Usage:   "Unprotected endpoints (mostly for live/readiness probes)",
@@ -49,16 +217,50 @@ func main() {
 					Usage:   "Protected endpoints (only accessible after authentication). Use an empty string to allow all.",
 					Value:   cli.NewStringSlice("/api/v1/series", "/api/v1/query", "/api/v1/query_range"),
 					EnvVars: []string{envPrefix + "PROTECTED_ENDPOINTS"},
-				}, &cli.StringFlag{
+				}, &cli.StringSliceFlag{
 					Name:    "auth-type",
-					Usage:   "Auth mechanism: one of 'basic' or 'jwt'",
-					Value:   "basic",
+					Usage:   "Auth mechanisms: one or more of 'basic', 'jwt' or 'ldap', tried in order",
+					Value:   cli.NewStringSlice("basic"),
 					EnvVars: []string{envPrefix + "AUTH_TYPE"},
-				}, &cli.StringFlag{
+				}, &cli.StringSliceFlag{
 					Name:    "auth-config",
-					Usage:   "AuthN yaml configuration file path (basic auth) or jwks file path/url (jwt auth)",
-					Value:   "authn.yaml",
+					Usage:   "AuthN yaml configuration file path (basic auth), jwks file path/url (jwt auth) or LDAP yaml configuration file path (ldap auth), one per auth-type",
+					Value:   cli.NewStringSlice("authn.yaml"),
 					EnvVars: []string{envPrefix + "AUTH_CONFIG"},
+				}, &cli.StringFlag{
+					Name:    "policy-config",
+					Usage:   "Authorization policy yaml file path granting namespaces, labels and endpoints to users and groups. Overrides the scope provided by the auth mechanisms.",
+					EnvVars: []string{envPrefix + "POLICY_CONFIG"},
+				}, &cli.Float64Flag{
+					Name:    "rate-limit",
+					Usage:   "Default number of requests per second allowed for every user, unlimited if 0. Users, groups and policy rules can override it.",
+					EnvVars: []string{envPrefix + "RATE_LIMIT"},
+				}, &cli.IntFlag{
+					Name:    "rate-limit-burst",
+					Usage:   "Default number of requests allowed at once for every user, rate-limit rounded up if 0",
+					EnvVars: []string{envPrefix + "RATE_LIMIT_BURST"},
+				}, &cli.BoolFlag{
+					Name:    "rate-limit-per-endpoint",
+					Usage:   "If true, apply the default rate limit to every endpoint separately",
+					EnvVars: []string{envPrefix + "RATE_LIMIT_PER_ENDPOINT"},
+				}, &cli.IntFlag{
+					Name:    "max-concurrent-requests",
+					Usage:   "Maximum number of requests in flight for all the users, unlimited if 0",
+					EnvVars: []string{envPrefix + "MAX_CONCURRENT_REQUESTS"},
+				}, &cli.IntFlag{
+					Name:    "max-concurrent-requests-per-user",
+					Usage:   "Maximum number of requests in flight for every user, unlimited if 0",
+					EnvVars: []string{envPrefix + "MAX_CONCURRENT_REQUESTS_PER_USER"},
+				}, &cli.IntFlag{
+					Name:    "max-queued-requests",
+					Usage:   "Maximum number of requests waiting for a slot when a concurrency limit is reached, for every limit",
+					Value:   10,
+					EnvVars: []string{envPrefix + "MAX_QUEUED_REQUESTS"},
+				}, &cli.DurationFlag{
+					Name:    "queue-timeout",
+					Usage:   "Maximum time a request waits for a slot when a concurrency limit is reached, until the client goes away if 0",
+					Value:   30 * time.Second,
+					EnvVars: []string{envPrefix + "QUEUE_TIMEOUT"},
 				}, &cli.IntFlag{
 					Name:    "reload-interval",
 					Usage:   "Interval time to reload the configuration (minutes)",
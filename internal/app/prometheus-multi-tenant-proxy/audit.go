@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AuditLogger writes one JSON line per request, recording who queried what
+type AuditLogger struct {
+	w    io.Writer
+	lock *sync.Mutex
+}
+
+// AuditRecord describes a request in the audit log
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	// User is the authenticated principal, empty if the authentication failed
+	User    string   `json:"user"`
+	Groups  []string `json:"groups,omitempty"`
+	Backend string   `json:"backend"`
+	// Auth is the outcome of the authentication and authorization, see authReason
+	Auth   string       `json:"auth"`
+	Tenant *AuditTenant `json:"tenant,omitempty"`
+	// Queries are the PromQL expressions, as sent by the user and as forwarded to Prometheus
+	Queries  []AuditQuery `json:"queries,omitempty"`
+	Start    string       `json:"start,omitempty"`
+	End      string       `json:"end,omitempty"`
+	EvalTime string       `json:"eval_time,omitempty"`
+	// Rejection is the reason the query was not forwarded to Prometheus
+	Rejection    string  `json:"rejection,omitempty"`
+	Status       int     `json:"status"`
+	ResponseSize int64   `json:"response_size"`
+	Duration     float64 `json:"duration_seconds"`
+}
+
+// AuditTenant is the scope the user has access to
+type AuditTenant struct {
+	Namespaces         []string            `json:"namespaces,omitempty"`
+	Labels             map[string][]string `json:"labels,omitempty"`
+	ExcludedNamespaces []string            `json:"excluded_namespaces,omitempty"`
+	ExcludedLabels     map[string][]string `json:"excluded_labels,omitempty"`
+}
+
+// AuditQuery is a PromQL expression of a request
+type AuditQuery struct {
+	Param    string `json:"param"`
+	Original string `json:"original"`
+	Enforced string `json:"enforced"`
+}
+
+// NewAuditLogger creates an AuditLogger writing to the standard output if location is "-",
+// or to the file at location, rotated when reaching maxSize megabytes. maxBackups and maxAge
+// (in days) limit the rotated files kept, all of them are kept if 0.
+func NewAuditLogger(location string, maxSize, maxBackups, maxAge int) *AuditLogger {
+	if location == "-" {
+		return newAuditLoggerFromWriter(os.Stdout)
+	}
+	return newAuditLoggerFromWriter(&lumberjack.Logger{
+		Filename:   location,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+	})
+}
+
+func newAuditLoggerFromWriter(w io.Writer) *AuditLogger {
+	return &AuditLogger{
+		w:    w,
+		lock: new(sync.Mutex),
+	}
+}
+
+// Write writes the record as a JSON line
+func (a *AuditLogger) Write(record *AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Could not encode audit record", "err", err)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		slog.Error("Could not write audit record", "err", err)
+	}
+}
+
+// AuditHandler returns a middleware handler writing an audit record for every request.
+// The inner handlers complete the record of the request, see auditRecord.
+// A nil AuditLogger disables the audit log.
+func AuditHandler(audit *AuditLogger, handler http.HandlerFunc) http.HandlerFunc {
+	if audit == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := &AuditRecord{
+			Time:       start.UTC(),
+			RequestID:  requestID(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), auditKey, record)))
+
+		record.Status = recorder.statusCode()
+		record.ResponseSize = recorder.size
+		record.Duration = time.Since(start).Seconds()
+		audit.Write(record)
+	}
+}
+
+// auditRecord returns the audit record of the request, nil if the audit log is disabled
+func auditRecord(ctx context.Context) *AuditRecord {
+	record, _ := ctx.Value(auditKey).(*AuditRecord)
+	return record
+}
+
+// setIdentity records the outcome of the authentication and the scope of the user
+func (record *AuditRecord) setIdentity(identity *Identity, backend string, err error) {
+	if record == nil {
+		return
+	}
+	record.Backend = backend
+	record.Auth = authReason(err)
+	if identity == nil {
+		return
+	}
+	record.User = identity.Name
+	record.Groups = identity.Groups
+	record.Tenant = &AuditTenant{
+		Namespaces:         identity.Namespaces,
+		Labels:             identity.Labels,
+		ExcludedNamespaces: identity.ExcludedNamespaces,
+		ExcludedLabels:     identity.ExcludedLabels,
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAudit_AuditHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	tripper := &ReversePrometheusRoundTripper{prometheusServerURL: upstreamURL}
+	reverseProxy := &httputil.ReverseProxy{Director: tripper.Director, Transport: tripper, ErrorHandler: tripper.ErrorHandler}
+
+	var buf bytes.Buffer
+	audit := newAuditLoggerFromWriter(&buf)
+	auth := &testAuth{authorized: true, namespaces: []string{"ns1"}}
+	handler := RequestIDHandler(AuditHandler(audit, AuthHandler(auth, nil, reverseProxy.ServeHTTP)))
+
+	testCases := []struct {
+		desc       string
+		authorized bool
+		query      string
+		expected   AuditRecord
+	}{
+		{
+			"query",
+			true,
+			"/api/v1/query_range?query=up&start=1700000000&end=1700003600&step=60",
+			AuditRecord{
+				Method:       http.MethodGet,
+				Path:         "/api/v1/query_range",
+				User:         "test",
+				Backend:      "unknown",
+				Auth:         "success",
+				Tenant:       &AuditTenant{Namespaces: []string{"ns1"}},
+				Queries:      []AuditQuery{{Param: "query", Original: "up", Enforced: `up{namespace="ns1"}`}},
+				Start:        "1700000000",
+				End:          "1700003600",
+				Status:       http.StatusOK,
+				ResponseSize: int64(len(`{"status":"success"}`)),
+			},
+		}, {
+			"rejected query",
+			true,
+			"/api/v1/query?query=up{",
+			AuditRecord{
+				Method:       http.MethodGet,
+				Path:         "/api/v1/query",
+				User:         "test",
+				Backend:      "unknown",
+				Auth:         "success",
+				Tenant:       &AuditTenant{Namespaces: []string{"ns1"}},
+				Queries:      []AuditQuery{{Param: "query", Original: "up{"}},
+				Rejection:    "1:4: parse error: unexpected end of input inside braces",
+				Status:       http.StatusBadRequest,
+				ResponseSize: -1,
+			},
+		}, {
+			"denied",
+			false,
+			"/api/v1/query?query=up",
+			AuditRecord{
+				Method:       http.MethodGet,
+				Path:         "/api/v1/query",
+				Backend:      "unknown",
+				Auth:         "invalid_credentials",
+				Status:       http.StatusUnauthorized,
+				ResponseSize: -1,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			buf.Reset()
+			auth.authorized = tc.authorized
+			r := httptest.NewRequest(http.MethodGet, tc.query, nil)
+			r.Header.Set("X-Request-ID", "abc")
+			handler(httptest.NewRecorder(), r)
+
+			var record AuditRecord
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("Invalid audit record %q: %v", buf.String(), err)
+			}
+			if record.RequestID != "abc" || record.Time.IsZero() || record.Duration <= 0 {
+				t.Errorf("Request not identified in the audit record: %s", buf.String())
+			}
+			if tc.expected.ResponseSize < 0 {
+				// The error body is not checked
+				tc.expected.ResponseSize = record.ResponseSize
+			}
+			record.Time, record.RequestID, record.RemoteAddr, record.Duration = tc.expected.Time, "", "", 0
+			if !reflect.DeepEqual(record, tc.expected) {
+				t.Errorf("AuditRecord = %+v, expected %+v", record, tc.expected)
+			}
+		})
+	}
+}
+
+func TestAudit_Disabled(t *testing.T) {
+	called := false
+	handler := AuditHandler(nil, func(w http.ResponseWriter, r *http.Request) {
+		called = auditRecord(r.Context()) == nil
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+	if !called {
+		t.Errorf("Requests should not be audited without AuditLogger")
+	}
+}
+
+func TestAudit_NewAuditLogger(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "audit.log")
+	audit := NewAuditLogger(location, 1, 1, 0)
+	audit.Write(&AuditRecord{User: "alice", Tenant: &AuditTenant{Labels: map[string][]string{"team": {"a"}}}})
+	audit.Write(&AuditRecord{User: "bob"})
+
+	content, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"user":"alice"`) || !strings.Contains(lines[0], `"labels":{"team":["a"]}`) {
+		t.Errorf("Unexpected audit log: %s", content)
+	}
+}
@@ -2,51 +2,204 @@ package proxy
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
 )
 
 type key int
 
+// Identity describes an authenticated user and the scope it has access to
+type Identity struct {
+	// Name of the user: the username for basic and ldap auth, the subject for jwt auth
+	Name string
+	// Groups the user belongs to
+	Groups []string
+	// Namespaces the user has access to
+	Namespaces []string
+	// Labels that will be injected for the user
+	Labels map[string][]string
+	// ExcludedNamespaces the user has no access to, even if allowed by Labels
+	ExcludedNamespaces []string
+	// ExcludedLabels that will be injected as negative matchers for the user
+	ExcludedLabels map[string][]string
+	// Endpoints the user is allowed to request among the protected endpoints, all of them if empty
+	Endpoints []string
+	// Methods the user is allowed to use, all of them if empty
+	Methods []string
+	// RateLimit limits the requests of the user, the default rate limit applies if nil
+	RateLimit *pkg.RateLimit
+	// QueryLimits restricts the queries of the user, unlimited if nil
+	QueryLimits *pkg.QueryLimits
+}
+
+// AuthError describes why a request is denied
+type AuthError struct {
+	// Status is the HTTP status code of the response
+	Status int
+	// Reason is the error message returned to the client
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return e.Reason
+}
+
+var (
+	errMissingCredentials = &AuthError{Status: http.StatusUnauthorized, Reason: "missing credentials"}
+	errInvalidCredentials = &AuthError{Status: http.StatusUnauthorized, Reason: "invalid credentials"}
+	errAuthUnavailable    = &AuthError{Status: http.StatusServiceUnavailable, Reason: "authentication backend unavailable"}
+	errNoScope            = &AuthError{Status: http.StatusForbidden, Reason: "no namespaces or labels granted"}
+	errEndpointForbidden  = &AuthError{Status: http.StatusForbidden, Reason: "endpoint not allowed"}
+	errMethodForbidden    = &AuthError{Status: http.StatusForbidden, Reason: "method not allowed"}
+)
+
 // Auth implements an authentication middleware
 type Auth interface {
-	// IsAuthorized authenticates a request and returns the list of namespaces the user has access to
-	IsAuthorized(r *http.Request) (bool, []string, map[string][]string)
-	// WriteUnauthorisedResponse writes an HTTP response in case the user is forbidden
-	WriteUnauthorisedResponse(w http.ResponseWriter)
+	// IsAuthorized authenticates a request and returns the identity of the user,
+	// or an *AuthError if the request is denied
+	IsAuthorized(r *http.Request) (*Identity, error)
+	// WriteUnauthorisedResponse writes an HTTP response in case the request is denied
+	WriteUnauthorisedResponse(w http.ResponseWriter, err error)
 	// Load loads or reloads the configuration
 	Load() bool
+	// Recognizes returns true if the request carries credentials this backend can verify
+	Recognizes(r *http.Request) bool
 }
 
-// AuthHandler returns au authentication middleware handler
-func AuthHandler(auth Auth, whitelist []string, handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if whitelist != nil && !isInWhitelist(r.URL.Path, whitelist) {
-			auth.WriteUnauthorisedResponse(w)
-			return
-		}
+// Challenger is implemented by Auth backends advertising their authentication
+// scheme through the WWW-Authenticate header
+type Challenger interface {
+	// Challenges returns the values of the WWW-Authenticate header
+	Challenges() []string
+}
 
-		authorized, namespaces, labels := auth.IsAuthorized(r)
-		if !authorized {
-			auth.WriteUnauthorisedResponse(w)
-			return
+// LoadReporter is implemented by Auth backends reporting when their
+// configuration was last loaded successfully
+type LoadReporter interface {
+	// LoadedAt returns the time of the last successful load, zero if never loaded
+	LoadedAt() time.Time
+}
+
+// AuthHandler returns au authentication middleware handler.
+// Requests with missing or invalid credentials get a 401 Unauthorized response, and
+// authenticated users without scope, requesting an endpoint or using a method they are
+// not allowed to get a 403 Forbidden response. A nil whitelist allows all the endpoints.
+func AuthHandler(auth Auth, whitelist *RouteMatcher, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer().Start(r.Context(), "auth")
+		identity, err := authorize(auth, whitelist, r.WithContext(ctx))
+		observeAuth(auth, r.WithContext(ctx), identity, err)
+		endSpan(span, err)
+		if identity != nil {
+			if m, ok := r.Context().Value(metricsKey).(*requestMetrics); ok {
+				m.user = identity.Name
+			}
+			traceIdentity(r.Context(), identity)
 		}
-		if len(namespaces) == 0 && len(labels) == 0 {
-			log.Printf("[WARNING] No namespaces or labels found for request")
-			auth.WriteUnauthorisedResponse(w)
+		if err != nil {
+			auth.WriteUnauthorisedResponse(w, err)
 			return
 		}
-		ctx := context.WithValue(r.Context(), Namespaces, namespaces)
-		ctx = context.WithValue(ctx, Labels, labels)
+		r = withLogger(r, "user", identity.Name, "tenant", identity.Namespaces)
+		ctx = context.WithValue(r.Context(), Namespaces, identity.Namespaces)
+		ctx = context.WithValue(ctx, Labels, identity.Labels)
+		ctx = context.WithValue(ctx, ExcludedNamespaces, identity.ExcludedNamespaces)
+		ctx = context.WithValue(ctx, ExcludedLabels, identity.ExcludedLabels)
+		ctx = context.WithValue(ctx, IdentityKey, identity)
+		ctx = context.WithValue(ctx, backendKey, authBackend(auth, r))
 		handler(w, r.WithContext(ctx))
 	}
 }
 
-func isInWhitelist(requestPath string, whitelist []string) bool {
-	allowed := false
-	for _, endpoint := range whitelist {
-		allowed = allowed || strings.HasSuffix(requestPath, endpoint)
+// authorize authenticates the user and checks it is allowed to send the request.
+// The identity is returned with the error if the user is authenticated but not allowed.
+func authorize(auth Auth, whitelist *RouteMatcher, r *http.Request) (*Identity, error) {
+	identity, err := auth.IsAuthorized(r)
+	if err != nil {
+		return nil, err
+	}
+	if !identity.hasConstraints() {
+		requestLogger(r.Context()).Warn("No namespaces or labels found", "user", identity.Name)
+		return identity, errNoScope
+	}
+	// The endpoints of the user narrow the protected endpoints, they never extend them
+	if (whitelist != nil && !whitelist.Match(r.URL.Path)) ||
+		(len(identity.Endpoints) > 0 && !whitelist.WithPatterns(identity.Endpoints).Match(r.URL.Path)) {
+		requestLogger(r.Context()).Warn("Endpoint not allowed", "user", identity.Name, "endpoint", r.URL.Path)
+		return identity, errEndpointForbidden
+	}
+	if len(identity.Methods) > 0 && !isMethodAllowed(r.Method, identity.Methods) {
+		requestLogger(r.Context()).Warn("Method not allowed", "user", identity.Name, "method", r.Method)
+		return identity, errMethodForbidden
+	}
+	return identity, nil
+}
+
+// hasConstraints returns true if at least one namespace or label constraint restricts the identity
+func (identity *Identity) hasConstraints() bool {
+	return len(identity.Namespaces) > 0 || len(identity.Labels) > 0 ||
+		len(identity.ExcludedNamespaces) > 0 || len(identity.ExcludedLabels) > 0
+}
+
+// writeAuthError writes the error with the Prometheus API error format.
+// The challenges are only sent with 401 Unauthorized responses.
+func writeAuthError(w http.ResponseWriter, challenges []string, err error) {
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		authErr = &AuthError{Status: http.StatusUnauthorized, Reason: err.Error()}
+	}
+	if authErr.Status == http.StatusUnauthorized {
+		for _, challenge := range challenges {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+	writeErrorResponse(w, authErr.Status, authErr.Reason)
+}
+
+// writeErrorResponse writes an error with the Prometheus API error format
+func writeErrorResponse(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{
+		Status:    "error",
+		ErrorType: errorType(status),
+		Error:     message,
+	})
+}
+
+// apiError is the error response of the Prometheus API
+type apiError struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+func errorType(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return "unavailable"
+	case http.StatusBadRequest:
+		return "bad_data"
+	}
+	return "internal"
+}
+
+func isMethodAllowed(method string, methods []string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(method, m) {
+			return true
+		}
 	}
-	return allowed
+	return false
 }
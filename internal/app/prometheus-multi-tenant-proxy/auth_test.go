@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -12,21 +14,37 @@ type testAuth struct {
 	authorized bool
 	namespaces []string
 	labels     map[string][]string
+	endpoints  []string
+	methods    []string
 	wasDenied  bool
 }
 
-func (a *testAuth) IsAuthorized(r *http.Request) (bool, []string, map[string][]string) {
-	return a.authorized, a.namespaces, a.labels
+func (a *testAuth) IsAuthorized(r *http.Request) (*Identity, error) {
+	if !a.authorized {
+		return nil, errInvalidCredentials
+	}
+	return &Identity{
+		Name:       "test",
+		Namespaces: a.namespaces,
+		Labels:     a.labels,
+		Endpoints:  a.endpoints,
+		Methods:    a.methods,
+	}, nil
 }
 
-func (a *testAuth) WriteUnauthorisedResponse(w http.ResponseWriter) {
-	a.wasDenied = true
+func (a *testAuth) WriteUnauthorisedResponse(w http.ResponseWriter, err error) {
+	a.wasDenied = errors.Is(err, errMissingCredentials) || errors.Is(err, errInvalidCredentials)
+	writeAuthError(w, []string{"Test"}, err)
 }
 
 func (a *testAuth) Load() bool {
 	return true
 }
 
+func (a *testAuth) Recognizes(r *http.Request) bool {
+	return true
+}
+
 func TestAuth_Ctx(t *testing.T) {
 	ns := []string{"ns1", "ns2"}
 	labels := map[string][]string{"label1": []string{"value1"}, "label2": []string{"value2"}}
@@ -52,6 +70,9 @@ func TestAuth_Ctx(t *testing.T) {
 	if !reflect.DeepEqual(labels, r.Context().Value(Labels).(map[string][]string)) {
 		t.Errorf("Labels should be set")
 	}
+	if identity := r.Context().Value(IdentityKey).(*Identity); identity.Name != "test" {
+		t.Errorf("Identity should be set")
+	}
 }
 
 func TestAuth_Whitelist(t *testing.T) {
@@ -78,10 +99,92 @@ func TestAuth_Whitelist(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("%v", tc.whitelist), func(t *testing.T) {
-			auth.wasDenied = false // reset
-			AuthHandler(auth, tc.whitelist, h)(httptest.NewRecorder(), r)
-			if auth.wasDenied == tc.ok {
-				t.Errorf("Whitelist %v should return ok=%v", tc.whitelist, tc.ok)
+			w := httptest.NewRecorder()
+			var whitelist *RouteMatcher
+			if tc.whitelist != nil {
+				whitelist = NewRouteMatcher("", tc.whitelist)
+			}
+			AuthHandler(auth, whitelist, h)(w, r)
+			if auth.wasDenied {
+				t.Errorf("Authenticated users should not be asked for credentials")
+			}
+			if (w.Code == http.StatusForbidden) == tc.ok {
+				t.Errorf("Whitelist %v should return ok=%v, got status %d", tc.whitelist, tc.ok, w.Code)
+			}
+		})
+	}
+}
+
+func TestAuth_IdentityEndpoints(t *testing.T) {
+	testCases := []struct {
+		endpoints []string
+		methods   []string
+		method    string
+		path      string
+		ok        bool
+	}{
+		{nil, nil, "GET", "/foo", true},
+		{nil, nil, "GET", "/api/v1/read", false},
+		{[]string{"/foo"}, nil, "GET", "/foo", true},
+		{[]string{"/bar"}, nil, "GET", "/foo", false},
+		{[]string{"/bar", "/foo"}, nil, "GET", "/foo", true},
+		{[]string{"/api/v1/read"}, nil, "POST", "/api/v1/read", false},
+		{[]string{"/api/v1/read", "/foo"}, nil, "GET", "/foo", true},
+		{[]string{"*"}, nil, "GET", "/api/v1/status/config", false},
+		{[]string{"*"}, nil, "GET", "/foo", true},
+		{nil, []string{"GET"}, "GET", "/foo", true},
+		{nil, []string{"get"}, "GET", "/foo", true},
+		{nil, []string{"GET"}, "POST", "/foo", false},
+		{nil, []string{"GET", "POST"}, "POST", "/foo", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v %v %s %s", tc.endpoints, tc.methods, tc.method, tc.path), func(t *testing.T) {
+			auth := &testAuth{
+				authorized: true,
+				namespaces: []string{"ns"},
+				endpoints:  tc.endpoints,
+				methods:    tc.methods,
+			}
+			handlerCalled := false
+			h := func(w http.ResponseWriter, req *http.Request) {
+				handlerCalled = true
+			}
+			r := httptest.NewRequest(tc.method, "http://example.com"+tc.path, nil)
+			w := httptest.NewRecorder()
+			AuthHandler(auth, NewRouteMatcher("", []string{"/foo", "/bar"}), h)(w, r)
+			if handlerCalled != tc.ok {
+				t.Errorf("handler called: %v should have been %v", handlerCalled, tc.ok)
+			}
+			if !tc.ok && w.Code != http.StatusForbidden {
+				t.Errorf("Wrong status code: %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestAuth_IdentityEndpointsPrefix(t *testing.T) {
+	testCases := []struct {
+		path string
+		ok   bool
+	}{
+		{"/prom/api/v1/query", true},
+		{"/prom/api/v1/series", false},
+		{"/api/v1/query", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			auth := &testAuth{authorized: true, namespaces: []string{"ns"}, endpoints: []string{"/api/v1/query"}}
+			handlerCalled := false
+			r := httptest.NewRequest("GET", "http://example.com"+tc.path, nil)
+			w := httptest.NewRecorder()
+			// Protection is turned off, but the endpoints of the user are matched under the route prefix
+			AuthHandler(auth, NewAllowAllRouteMatcher("/prom"), func(w http.ResponseWriter, req *http.Request) {
+				handlerCalled = true
+			})(w, r)
+			if handlerCalled != tc.ok {
+				t.Errorf("handler called: %v should have been %v", handlerCalled, tc.ok)
 			}
 		})
 	}
@@ -97,14 +200,14 @@ func TestAuth_AuthHandler(t *testing.T) {
 		authorized bool
 		ns         []string
 		ls         map[string][]string
-		ok         bool
+		status     int
 	}{
-		{true, ns, ls, true},
-		{true, ns, noLs, true},
-		{true, noNs, ls, true},
-		{true, noNs, noLs, false},
-		{false, ns, ls, false},
-		{false, noNs, noLs, false},
+		{true, ns, ls, http.StatusOK},
+		{true, ns, noLs, http.StatusOK},
+		{true, noNs, ls, http.StatusOK},
+		{true, noNs, noLs, http.StatusForbidden},
+		{false, ns, ls, http.StatusUnauthorized},
+		{false, noNs, noLs, http.StatusUnauthorized},
 	}
 
 	for _, tc := range testCases {
@@ -126,43 +229,75 @@ func TestAuth_AuthHandler(t *testing.T) {
 			w := httptest.NewRecorder()
 
 			AuthHandler(auth, nil, handler)(w, r)
-			if tc.ok != handlerCalled {
-				t.Errorf("handler called: %v should have been %v", handlerCalled, tc.ok)
+			ok := tc.status == http.StatusOK
+			if ok != handlerCalled {
+				t.Errorf("handler called: %v should have been %v", handlerCalled, ok)
 			}
-			if tc.ok == auth.wasDenied {
-				t.Errorf("denied: %v should have been %v", handlerCalled, tc.ok)
+			if w.Code != tc.status {
+				t.Errorf("Wrong status code: %d, expected %d", w.Code, tc.status)
+			}
+			if (tc.status == http.StatusUnauthorized) != auth.wasDenied {
+				t.Errorf("asked for credentials: %v should have been %v", auth.wasDenied, !ok)
 			}
 		})
 	}
 }
 
-func TestAuth_isInWhitelist(t *testing.T) {
-	whitelist := []string{
-		"/api/v1/query",
-		"/foo",
-	}
-
+func TestAuth_ErrorResponse(t *testing.T) {
 	testCases := []struct {
-		path     string
-		expected bool
+		err       error
+		status    int
+		errorType string
+		challenge bool
 	}{
-		{"", false},
-		{"/foo", true},
-		{"/bar/foo", true},
-		{"/foo/bar", false},
-		{"/api/v1/query", true},
-		{"/v1/query", false},
-		{"/api/v2/query", false},
+		{errMissingCredentials, http.StatusUnauthorized, "unauthorized", true},
+		{errInvalidCredentials, http.StatusUnauthorized, "unauthorized", true},
+		{errNoScope, http.StatusForbidden, "forbidden", false},
+		{errEndpointForbidden, http.StatusForbidden, "forbidden", false},
+		{errAuthUnavailable, http.StatusServiceUnavailable, "unavailable", false},
+		{errors.New("unknown"), http.StatusUnauthorized, "unauthorized", true},
 	}
 
 	for _, tc := range testCases {
-		t.Run(tc.path, func(t *testing.T) {
-			if isInWhitelist("https://example.com"+tc.path, whitelist) != tc.expected {
-				t.Errorf("%s != %v", tc.path, tc.expected)
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeAuthError(w, []string{"Basic", "Bearer"}, tc.err)
+			if w.Code != tc.status {
+				t.Errorf("Wrong status code: %d", w.Code)
+			}
+			if challenges := w.Header().Values("WWW-Authenticate"); (len(challenges) == 2) != tc.challenge {
+				t.Errorf("Wrong challenges: %v", challenges)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Wrong content type: %s", contentType)
 			}
-			if isInWhitelist("https://example.com/some-path"+tc.path, whitelist) != tc.expected {
-				t.Errorf("%s != %v", tc.path, tc.expected)
+			var body apiError
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Invalid JSON body %q: %v", w.Body.String(), err)
+			}
+			expected := apiError{Status: "error", ErrorType: tc.errorType, Error: tc.err.Error()}
+			if body != expected {
+				t.Errorf("Got unexpected body: %+v", body)
 			}
 		})
 	}
 }
+
+func TestAuth_ExcludedOnly(t *testing.T) {
+	auth := &testIdentityAuth{identity: &Identity{
+		Name:               "test",
+		ExcludedNamespaces: []string{"kube-system"},
+	}}
+	r := httptest.NewRequest("GET", "http://example.com", nil)
+	h := func(w http.ResponseWriter, req *http.Request) {
+		r = req
+	}
+
+	AuthHandler(auth, nil, h)(httptest.NewRecorder(), r)
+	if auth.wasDenied {
+		t.Errorf("Excluded namespaces should be enough to be allowed")
+	}
+	if !reflect.DeepEqual([]string{"kube-system"}, r.Context().Value(ExcludedNamespaces).([]string)) {
+		t.Errorf("Excluded namespaces should be set")
+	}
+}
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"time"
@@ -42,7 +41,7 @@ type AWSSigner struct {
 func NewAWSSigner() *AWSSigner {
 	creds := credentials.NewEnvCredentials()
 	if _, err := creds.Get(); err != nil {
-		log.Fatalf("failed to get AWS credentials: %v", err)
+		fatal("Failed to get AWS credentials", "err", err)
 	}
 
 	return &AWSSigner{
@@ -71,7 +70,7 @@ func (s *AWSSigner) SignAfter(director func(*http.Request)) func(*http.Request)
 func (s *AWSSigner) Sign(req *http.Request) error {
 	_, err := s.signer.Sign(req, nil, s.service, s.region, time.Now())
 	if err != nil {
-		log.Printf("Could not sign request: %s", err)
+		requestLogger(req.Context()).Error("Could not sign request", "err", err)
 	}
 	return err
 }
@@ -2,10 +2,11 @@ package proxy
 
 import (
 	"crypto/subtle"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
 )
@@ -15,7 +16,25 @@ const (
 	Namespaces key = iota
 	//Labels Key used to pass prometheus additional labels though the middleware context
 	Labels key = iota
-	realm      = "Prometheus multi-tenant proxy"
+	//IdentityKey Key used to pass the authenticated Identity though the middleware context
+	IdentityKey key = iota
+	//ExcludedNamespaces Key used to pass the namespaces hidden from the tenant though the middleware context
+	ExcludedNamespaces key = iota
+	//ExcludedLabels Key used to pass the labels hidden from the tenant though the middleware context
+	ExcludedLabels key = iota
+	//rejectionKey Key used to pass the reason a request is rejected from the Director to the RoundTripper
+	rejectionKey key = iota
+	//metricsKey Key used to pass the labels of the request metrics known by the inner handlers though the middleware context
+	metricsKey key = iota
+	//loggerKey Key used to pass the logger of the request though the middleware context
+	loggerKey key = iota
+	//requestIDKey Key used to pass the id of the request though the middleware context
+	requestIDKey key = iota
+	//auditKey Key used to pass the audit record completed by the inner handlers though the middleware context
+	auditKey key = iota
+	//backendKey Key used to pass the name of the backend authenticating the user though the middleware context
+	backendKey key = iota
+	realm          = "Prometheus multi-tenant proxy"
 )
 
 // BasicAuth can be used as a middleware chain to authenticate users
@@ -24,6 +43,7 @@ type BasicAuth struct {
 	configLocation string
 	config         *pkg.Authn
 	configLock     *sync.RWMutex
+	loadedAt       time.Time
 }
 
 // NewBasicAuth creates a BasicAuth, loading the Authn from configLocation
@@ -43,6 +63,7 @@ func newBasicAuthFromConfig(authn *pkg.Authn) *BasicAuth {
 	return &BasicAuth{
 		config:     authn,
 		configLock: new(sync.RWMutex),
+		loadedAt:   time.Now(),
 	}
 }
 
@@ -50,27 +71,50 @@ func newBasicAuthFromConfig(authn *pkg.Authn) *BasicAuth {
 func (auth *BasicAuth) Load() bool {
 	temp, err := pkg.ParseConfig(&auth.configLocation)
 	if err != nil {
-		log.Printf("Could not parse config file %s: %v", auth.configLocation, err)
+		slog.Error("Could not parse config file", "file", auth.configLocation, "err", err)
 		return false
 	}
 	auth.configLock.Lock()
 	auth.config = temp
+	auth.loadedAt = time.Now()
 	auth.configLock.Unlock()
-	log.Print("Reloaded authn configuration from file")
+	slog.Info("Reloaded authn configuration from file", "file", auth.configLocation)
 	return true
 }
 
+// LoadedAt returns the time the Authn was last loaded
+func (auth *BasicAuth) LoadedAt() time.Time {
+	auth.configLock.RLock()
+	defer auth.configLock.RUnlock()
+	return auth.loadedAt
+}
+
 // IsAuthorized uses the basic authentication and the Authn file to authenticate a user
 // and return the namespace he has access to
-func (auth *BasicAuth) IsAuthorized(r *http.Request) (bool, []string, map[string][]string) {
+func (auth *BasicAuth) IsAuthorized(r *http.Request) (*Identity, error) {
 	user, pass, ok := r.BasicAuth()
 	if !ok {
-		return false, nil, nil
+		return nil, errMissingCredentials
 	}
 	return auth.isAuthorized(user, pass)
 }
 
-func (auth *BasicAuth) isAuthorized(user, pass string) (bool, []string, map[string][]string) {
+// Recognizes returns true if the request uses basic authentication
+// with a user defined in the Authn file
+func (auth *BasicAuth) Recognizes(r *http.Request) bool {
+	user, _, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	for _, v := range auth.getConfig().Users {
+		if subtle.ConstantTimeCompare([]byte(user), []byte(v.Username)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *BasicAuth) isAuthorized(user, pass string) (*Identity, error) {
 	authConfig := auth.getConfig()
 	for _, v := range authConfig.Users {
 		if subtle.ConstantTimeCompare([]byte(user), []byte(v.Username)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(v.Password)) == 1 {
@@ -84,18 +128,33 @@ func (auth *BasicAuth) isAuthorized(user, pass string) (bool, []string, map[stri
 			if v.Namespaces != nil {
 				namespaces = append(namespaces, v.Namespaces...)
 			}
-			return true, namespaces, v.Labels
+			return &Identity{
+				Name:       v.Username,
+				Groups:     v.Groups,
+				Namespaces: namespaces,
+				Labels:     v.Labels,
+
+				ExcludedNamespaces: v.ExcludedNamespaces,
+				ExcludedLabels:     v.ExcludedLabels,
+				Endpoints:          v.Endpoints,
+				Methods:            v.Methods,
+				RateLimit:          v.RateLimit,
+				QueryLimits:        v.QueryLimits,
+			}, nil
 		}
 	}
-	return false, nil, nil
+	return nil, errInvalidCredentials
+}
+
+// WriteUnauthorisedResponse writes the error HTTP response, with
+// a redirect to basic authentication if the user is not authenticated
+func (auth *BasicAuth) WriteUnauthorisedResponse(w http.ResponseWriter, err error) {
+	writeAuthError(w, auth.Challenges(), err)
 }
 
-// WriteUnauthorisedResponse writes a 401 Unauthorized HTTP response with
-// a redirect to basic authentication
-func (auth *BasicAuth) WriteUnauthorisedResponse(w http.ResponseWriter) {
-	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
-	w.WriteHeader(401)
-	w.Write([]byte("Unauthorised\n"))
+// Challenges returns the basic authentication challenge
+func (auth *BasicAuth) Challenges() []string {
+	return []string{`Basic realm="` + realm + `"`}
 }
 
 func (auth *BasicAuth) getConfig() *pkg.Authn {
@@ -38,8 +38,7 @@ func TestBasic_isAuthorized(t *testing.T) {
 		name  string
 		args  args
 		want  bool
-		want1 []string
-		want2 map[string][]string
+		want1 *Identity
 	}{
 		{
 			"Valid User",
@@ -48,8 +47,10 @@ func TestBasic_isAuthorized(t *testing.T) {
 				"pass-a",
 			},
 			true,
-			[]string{"tenant-a"},
-			nil,
+			&Identity{
+				Name:       "User-a",
+				Namespaces: []string{"tenant-a"},
+			},
 		}, {
 			"Invalid User",
 			args{
@@ -58,21 +59,17 @@ func TestBasic_isAuthorized(t *testing.T) {
 			},
 			false,
 			nil,
-			nil,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1, got2 := auth.isAuthorized(tt.args.user, tt.args.pass)
-			if got != tt.want {
+			got1, err := auth.isAuthorized(tt.args.user, tt.args.pass)
+			if got := err == nil; got != tt.want {
 				t.Errorf("isAuthorized() got = %v, want %v", got, tt.want)
 			}
 			if !reflect.DeepEqual(got1, tt.want1) {
 				t.Errorf("isAuthorized() got1 = %v, want1 %v", got1, tt.want1)
 			}
-			if !reflect.DeepEqual(got2, tt.want2) {
-				t.Errorf("isAuthorized() got2 = %v, want2 %v", got2, tt.want2)
-			}
 		})
 	}
 }
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ChainAuth composes several Auth backends. The first backend that recognizes
+// the credentials of a request decides whether it is authorized.
+type ChainAuth struct {
+	auths []Auth
+}
+
+// NewChainAuth creates a ChainAuth trying the given backends in order
+func NewChainAuth(auths ...Auth) *ChainAuth {
+	return &ChainAuth{
+		auths: auths,
+	}
+}
+
+// Recognizes returns true if any of the chained backends recognizes the credentials
+func (chain *ChainAuth) Recognizes(r *http.Request) bool {
+	return chain.find(r) != nil
+}
+
+// IsAuthorized delegates the authentication to the first backend recognizing
+// the credentials of the request
+func (chain *ChainAuth) IsAuthorized(r *http.Request) (*Identity, error) {
+	auth := chain.find(r)
+	if auth == nil {
+		return nil, errMissingCredentials
+	}
+	return auth.IsAuthorized(r)
+}
+
+// WriteUnauthorisedResponse writes the error HTTP response, with one challenge
+// for every chained backend supporting it if the user is not authenticated
+func (chain *ChainAuth) WriteUnauthorisedResponse(w http.ResponseWriter, err error) {
+	writeAuthError(w, chain.Challenges(), err)
+}
+
+// Challenges returns the WWW-Authenticate challenges of all the chained backends in order,
+// once even if several backends share them, e.g. basic and ldap
+func (chain *ChainAuth) Challenges() []string {
+	challenges := make([]string, 0, len(chain.auths))
+	for _, auth := range chain.auths {
+		if c, ok := auth.(Challenger); ok {
+			for _, challenge := range c.Challenges() {
+				if !slices.Contains(challenges, challenge) {
+					challenges = append(challenges, challenge)
+				}
+			}
+		}
+	}
+	return challenges
+}
+
+// Load loads or reloads the configuration of every chained backend.
+// It returns false if any of them failed.
+func (chain *ChainAuth) Load() bool {
+	ok := true
+	for _, auth := range chain.auths {
+		ok = auth.Load() && ok
+	}
+	return ok
+}
+
+// LoadedAt returns the oldest of the times the configurations of the chained backends were last loaded
+func (chain *ChainAuth) LoadedAt() time.Time {
+	times := make([]time.Time, 0, len(chain.auths))
+	for _, auth := range chain.auths {
+		times = append(times, loadedAt(auth))
+	}
+	return oldest(times...)
+}
+
+func (chain *ChainAuth) find(r *http.Request) Auth {
+	for _, auth := range chain.auths {
+		if auth.Recognizes(r) {
+			return auth
+		}
+	}
+	return nil
+}
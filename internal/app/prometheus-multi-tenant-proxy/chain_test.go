@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+)
+
+func newTestChainAuth() *ChainAuth {
+	basic := newBasicAuthFromConfig(&pkg.Authn{
+		Users: []pkg.User{
+			{
+				Username:  "User-a",
+				Password:  "pass-a",
+				Namespace: "tenant-a",
+			},
+		},
+	})
+	return NewChainAuth(newJwtAuthFromString(jwksJSON), basic)
+}
+
+func TestChain_IsAuthorized(t *testing.T) {
+	chain := newTestChainAuth()
+
+	testCases := []struct {
+		desc       string
+		setupFunc  func(r *http.Request)
+		recognized bool
+		authorized bool
+		ns         []string
+	}{
+		{"no credentials", func(r *http.Request) {}, false, false, nil},
+		{"jwt: valid", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+validHmacToken) }, true, true, []string{"prometheus"}},
+		{"jwt: invalid", func(r *http.Request) { r.Header.Set("Token", "invalid") }, true, false, nil},
+		{"basic: valid", func(r *http.Request) { r.SetBasicAuth("User-a", "pass-a") }, true, true, []string{"tenant-a"}},
+		{"basic: wrong password", func(r *http.Request) { r.SetBasicAuth("User-a", "wrong") }, true, false, nil},
+		{"basic: unknown user", func(r *http.Request) { r.SetBasicAuth("unknown", "pass-a") }, false, false, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com", nil)
+			tc.setupFunc(r)
+			if recognized := chain.Recognizes(r); recognized != tc.recognized {
+				t.Errorf("recognized=%v, expected=%v", recognized, tc.recognized)
+			}
+			identity, err := chain.IsAuthorized(r)
+			authorized := err == nil
+			if authorized != tc.authorized {
+				t.Errorf("authorized=%v, expected=%v", authorized, tc.authorized)
+			}
+			if authorized && !reflect.DeepEqual(identity.Namespaces, tc.ns) {
+				t.Errorf("Got unexpected namespaces: %v", identity.Namespaces)
+			}
+		})
+	}
+}
+
+func TestChain_WriteUnauthorisedResponse(t *testing.T) {
+	ldap, _ := newTestLDAPAuth()
+	basic := newBasicAuthFromConfig(&pkg.Authn{})
+	bearer := `Bearer realm="` + realm + `"`
+	basicChallenge := `Basic realm="` + realm + `"`
+
+	testCases := []struct {
+		desc     string
+		chain    *ChainAuth
+		expected []string
+	}{
+		{"jwt and basic", newTestChainAuth(), []string{bearer, basicChallenge}},
+		{"basic and ldap", NewChainAuth(basic, ldap), []string{basicChallenge}},
+		{"basic, jwt and ldap", NewChainAuth(basic, newJwtAuthFromString(jwksJSON), ldap), []string{basicChallenge, bearer}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.chain.WriteUnauthorisedResponse(w, errMissingCredentials)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Wrong status code: %d", w.Code)
+			}
+			if challenges := w.Header().Values("WWW-Authenticate"); !reflect.DeepEqual(challenges, tc.expected) {
+				t.Errorf("Wrong challenges: %v, expected %v", challenges, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimiter limits the number of requests in flight, globally and for every user.
+// Requests over a limit wait in a bounded queue until a slot is released or the timeout expires.
+type ConcurrencyLimiter struct {
+	// global is shared by all the users, unlimited if nil
+	global *concurrencySlots
+	// perUser is the number of requests in flight allowed for every user, unlimited if 0
+	perUser   int
+	maxQueued int
+	timeout   time.Duration
+	users     map[string]*concurrencySlots
+	lock      *sync.Mutex
+}
+
+type concurrencySlots struct {
+	slots chan struct{}
+	// queued and refs are protected by the lock of the ConcurrencyLimiter
+	queued int
+	refs   int
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter allowing global requests in flight
+// and perUser requests in flight for every user, 0 meaning unlimited. At most maxQueued requests
+// wait for every limit, for up to timeout or until the client goes away if timeout is 0.
+func NewConcurrencyLimiter(global, perUser, maxQueued int, timeout time.Duration) *ConcurrencyLimiter {
+	limiter := &ConcurrencyLimiter{
+		perUser:   perUser,
+		maxQueued: maxQueued,
+		timeout:   timeout,
+		users:     make(map[string]*concurrencySlots),
+		lock:      new(sync.Mutex),
+	}
+	if global > 0 {
+		limiter.global = newConcurrencySlots(global)
+	}
+	return limiter
+}
+
+func newConcurrencySlots(size int) *concurrencySlots {
+	return &concurrencySlots{slots: make(chan struct{}, size)}
+}
+
+// ConcurrencyLimitHandler returns a middleware handler rejecting the requests exceeding the
+// limit of their user with a 429 Too Many Requests response, and the requests exceeding the
+// global limit with a 503 Service Unavailable response. When requests are limited per user,
+// the users without name are rejected with a 403 Forbidden response, as they cannot be told apart.
+// It must be called after AuthHandler, which sets the identity of the user and its backend.
+func ConcurrencyLimitHandler(limiter *ConcurrencyLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := r.Context().Value(IdentityKey).(*Identity)
+		if !ok {
+			handler(w, r)
+			return
+		}
+		if identity.Name == "" && limiter.perUser > 0 {
+			requestLogger(r.Context()).Warn("Concurrency limited user without name")
+			writeErrorResponse(w, http.StatusForbidden, "concurrency limited user without name")
+			return
+		}
+		backend, _ := r.Context().Value(backendKey).(string)
+		release, status := limiter.Acquire(r.Context(), backend, identity.Name)
+		if status != http.StatusOK {
+			requestLogger(r.Context()).Warn("Too many concurrent requests")
+			concurrencyLimitedRequests.WithLabelValues(concurrencyLimit(status)).Inc()
+			writeErrorResponse(w, status, "too many concurrent requests")
+			return
+		}
+		defer release()
+		handler(w, r)
+	}
+}
+
+// Acquire waits for a slot for the user authenticated by the given backend, then for a global slot.
+// It returns a function releasing them and http.StatusOK, or the status of the response if a limit
+// is exceeded. Users with the same name in different backends have their own slots.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, backend, user string) (func(), int) {
+	key := backend + "\x00" + user
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	var userSlots *concurrencySlots
+	if l.perUser > 0 {
+		userSlots = l.getUserSlots(key)
+		if !l.acquire(ctx, userSlots) {
+			l.putUserSlots(key, userSlots)
+			return nil, http.StatusTooManyRequests
+		}
+	}
+	if l.global != nil && !l.acquire(ctx, l.global) {
+		if userSlots != nil {
+			<-userSlots.slots
+			l.putUserSlots(key, userSlots)
+		}
+		return nil, http.StatusServiceUnavailable
+	}
+	return func() {
+		if l.global != nil {
+			<-l.global.slots
+		}
+		if userSlots != nil {
+			<-userSlots.slots
+			l.putUserSlots(key, userSlots)
+		}
+	}, http.StatusOK
+}
+
+// acquire takes a slot, waiting in the queue if all of them are in use
+func (l *ConcurrencyLimiter) acquire(ctx context.Context, s *concurrencySlots) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	l.lock.Lock()
+	if s.queued >= l.maxQueued {
+		l.lock.Unlock()
+		return false
+	}
+	s.queued++
+	l.lock.Unlock()
+	defer func() {
+		l.lock.Lock()
+		s.queued--
+		l.lock.Unlock()
+	}()
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// getUserSlots returns the slots of the user, which must be given back with putUserSlots
+func (l *ConcurrencyLimiter) getUserSlots(user string) *concurrencySlots {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s, found := l.users[user]
+	if !found {
+		s = newConcurrencySlots(l.perUser)
+		l.users[user] = s
+	}
+	s.refs++
+	return s
+}
+
+// putUserSlots removes the slots of the user once no request uses them
+func (l *ConcurrencyLimiter) putUserSlots(user string, s *concurrencySlots) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s.refs--
+	if s.refs == 0 {
+		delete(l.users, user)
+	}
+}
+
+func concurrencyLimit(status int) string {
+	if status == http.StatusTooManyRequests {
+		return "user"
+	}
+	return "global"
+}
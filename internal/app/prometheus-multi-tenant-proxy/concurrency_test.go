@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConcurrency_Acquire(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		global   int
+		perUser  int
+		inFlight []string
+		user     string
+		status   int
+	}{
+		{"unlimited", 0, 0, []string{"alice", "alice", "bob"}, "alice", http.StatusOK},
+		{"user limit", 0, 2, []string{"alice", "alice"}, "alice", http.StatusTooManyRequests},
+		{"other user", 0, 2, []string{"alice", "alice"}, "bob", http.StatusOK},
+		{"global limit", 2, 0, []string{"alice", "bob"}, "carol", http.StatusServiceUnavailable},
+		{"user limit first", 2, 1, []string{"alice", "bob"}, "alice", http.StatusTooManyRequests},
+		{"under limits", 3, 2, []string{"alice", "bob"}, "alice", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			limiter := NewConcurrencyLimiter(tc.global, tc.perUser, 0, time.Second)
+			for _, user := range tc.inFlight {
+				if _, status := limiter.Acquire(context.Background(), "basic", user); status != http.StatusOK {
+					t.Fatalf("In flight request of %s got status %d", user, status)
+				}
+			}
+			if _, status := limiter.Acquire(context.Background(), "basic", tc.user); status != tc.status {
+				t.Errorf("Got status %d, expected %d", status, tc.status)
+			}
+		})
+	}
+}
+
+func TestConcurrency_Backends(t *testing.T) {
+	limiter := NewConcurrencyLimiter(0, 1, 0, time.Second)
+	if _, status := limiter.Acquire(context.Background(), "basic", "alice"); status != http.StatusOK {
+		t.Fatalf("First request got status %d", status)
+	}
+	if _, status := limiter.Acquire(context.Background(), "jwt", "alice"); status != http.StatusOK {
+		t.Errorf("Users of other backends should not be limited, got status %d", status)
+	}
+	if _, status := limiter.Acquire(context.Background(), "basic", "alice"); status != http.StatusTooManyRequests {
+		t.Errorf("Same user should be limited, got status %d", status)
+	}
+}
+
+func TestConcurrency_HandlerWithoutName(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		perUser int
+		status  int
+	}{
+		{"global limit only", 0, http.StatusOK},
+		{"user limit", 1, http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			limiter := NewConcurrencyLimiter(10, tc.perUser, 0, time.Second)
+			h := ConcurrencyLimitHandler(limiter, func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest("GET", "http://example.com/api/v1/query", nil)
+			r = r.WithContext(context.WithValue(r.Context(), IdentityKey, &Identity{}))
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tc.status {
+				t.Errorf("Wrong status code: %d, expected %d", w.Code, tc.status)
+			}
+			if len(limiter.users) != 0 {
+				t.Errorf("Users without name should not get slots")
+			}
+		})
+	}
+}
+
+func TestConcurrency_Release(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1, 1, 0, time.Second)
+	release, status := limiter.Acquire(context.Background(), "basic", "alice")
+	if status != http.StatusOK {
+		t.Fatalf("Got status %d", status)
+	}
+	if _, status := limiter.Acquire(context.Background(), "basic", "bob"); status != http.StatusServiceUnavailable {
+		t.Errorf("Global limit should be reached, got status %d", status)
+	}
+	if len(limiter.users) != 1 {
+		t.Errorf("Rejected users should not keep slots: %v", limiter.users)
+	}
+	release()
+	if len(limiter.users) != 0 {
+		t.Errorf("Idle users should be removed: %v", limiter.users)
+	}
+	if _, status := limiter.Acquire(context.Background(), "basic", "bob"); status != http.StatusOK {
+		t.Errorf("Released slots should be available, got status %d", status)
+	}
+}
+
+func TestConcurrency_Queue(t *testing.T) {
+	limiter := NewConcurrencyLimiter(0, 1, 1, time.Second)
+	release, _ := limiter.Acquire(context.Background(), "basic", "alice")
+
+	acquired := make(chan int)
+	go func() {
+		_, status := limiter.Acquire(context.Background(), "basic", "alice")
+		acquired <- status
+	}()
+	// Wait for the request to be queued
+	for queued := 0; queued == 0; {
+		time.Sleep(time.Millisecond)
+		limiter.lock.Lock()
+		queued = limiter.users["basic\x00alice"].queued
+		limiter.lock.Unlock()
+	}
+	if _, status := limiter.Acquire(context.Background(), "basic", "alice"); status != http.StatusTooManyRequests {
+		t.Errorf("Full queue should reject requests, got status %d", status)
+	}
+	release()
+	if status := <-acquired; status != http.StatusOK {
+		t.Errorf("Queued request should get the released slot, got status %d", status)
+	}
+}
+
+func TestConcurrency_QueueTimeout(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1, 0, 1, 10*time.Millisecond)
+	limiter.Acquire(context.Background(), "basic", "alice")
+
+	start := time.Now()
+	if _, status := limiter.Acquire(context.Background(), "basic", "bob"); status != http.StatusServiceUnavailable {
+		t.Errorf("Queued request should time out, got status %d", status)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Request should wait for the timeout, waited %v", elapsed)
+	}
+	if limiter.global.queued != 0 {
+		t.Errorf("Timed out request should leave the queue")
+	}
+}
+
+func TestConcurrency_Handler(t *testing.T) {
+	limiter := NewConcurrencyLimiter(0, 1, 0, time.Second)
+	identity := &Identity{Name: "alice"}
+	var inner http.HandlerFunc
+	h := ConcurrencyLimitHandler(limiter, func(w http.ResponseWriter, r *http.Request) {
+		if inner != nil {
+			inner(w, r)
+		}
+	})
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("GET", "http://example.com/api/v1/query_range", nil)
+		return r.WithContext(context.WithValue(r.Context(), IdentityKey, identity))
+	}
+
+	rejected := testutil.ToFloat64(concurrencyLimitedRequests.WithLabelValues("user"))
+	var status int
+	inner = func(w http.ResponseWriter, r *http.Request) {
+		// A second request while the first one is in flight
+		w2 := httptest.NewRecorder()
+		h(w2, newRequest())
+		status = w2.Code
+	}
+	h(httptest.NewRecorder(), newRequest())
+	if status != http.StatusTooManyRequests {
+		t.Errorf("Concurrent request got status %d", status)
+	}
+	if count := testutil.ToFloat64(concurrencyLimitedRequests.WithLabelValues("user")); count != rejected+1 {
+		t.Errorf("Rejected requests counter is %v, expected %v", count, rejected+1)
+	}
+
+	inner = nil
+	w := httptest.NewRecorder()
+	h(w, newRequest())
+	if w.Code != http.StatusOK {
+		t.Errorf("Request after release got status %d", w.Code)
+	}
+}
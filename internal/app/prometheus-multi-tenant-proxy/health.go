@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ProxyHealthyPath is the liveness endpoint of the proxy
+	ProxyHealthyPath = "/-/proxy/healthy"
+	// ProxyReadyPath is the readiness endpoint of the proxy
+	ProxyReadyPath = "/-/proxy/ready"
+)
+
+// HealthOptions configures the readiness checks of the proxy
+type HealthOptions struct {
+	// MaxConfigAge is the maximum time since the auth configuration was last loaded, no limit if 0
+	MaxConfigAge time.Duration
+	// Upstream is the Prometheus server whose /-/ready endpoint is checked, not checked if nil
+	Upstream *url.URL
+	// Transport sends the upstream checks, http.DefaultTransport if nil
+	Transport http.RoundTripper
+}
+
+// Health reports the state of the proxy on its own liveness and readiness endpoints
+type Health struct {
+	auth    Auth
+	options HealthOptions
+	healthy *RouteMatcher
+	ready   *RouteMatcher
+}
+
+// NewHealth creates a Health serving the endpoints under routePrefix and checking the auth backend
+func NewHealth(auth Auth, routePrefix string, options HealthOptions) *Health {
+	return &Health{
+		auth:    auth,
+		options: options,
+		healthy: NewRouteMatcher(routePrefix, []string{ProxyHealthyPath}),
+		ready:   NewRouteMatcher(routePrefix, []string{ProxyReadyPath}),
+	}
+}
+
+// HealthHandler can be used as a middleware chain to serve the liveness and readiness
+// endpoints of the proxy, without authentication, before proxying the other requests.
+// The liveness endpoint succeeds as long as the proxy serves requests, and the readiness
+// endpoint gets a 503 Service Unavailable response if any check fails
+func HealthHandler(health *Health, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case health.healthy.Match(r.URL.Path):
+			io.WriteString(w, "Prometheus multi-tenant proxy is Healthy.\n")
+		case health.ready.Match(r.URL.Path):
+			if errs := health.Check(r.Context()); len(errs) > 0 {
+				writeErrorResponse(w, http.StatusServiceUnavailable, "not ready: "+strings.Join(errs, ", "))
+				return
+			}
+			io.WriteString(w, "Prometheus multi-tenant proxy is Ready.\n")
+		default:
+			handler(w, r)
+		}
+	}
+}
+
+// Check returns the failed readiness checks
+func (health *Health) Check(ctx context.Context) []string {
+	var errs []string
+	if err := health.checkAuth(time.Now()); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if health.options.Upstream != nil {
+		if err := health.checkUpstream(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+func (health *Health) checkAuth(now time.Time) error {
+	if _, ok := health.auth.(LoadReporter); !ok {
+		return nil
+	}
+	loaded := loadedAt(health.auth)
+	if loaded.IsZero() {
+		return fmt.Errorf("auth configuration not loaded")
+	}
+	if age := now.Sub(loaded); health.options.MaxConfigAge > 0 && age > health.options.MaxConfigAge {
+		return fmt.Errorf("auth configuration last loaded %s ago", age.Truncate(time.Second))
+	}
+	return nil
+}
+
+func (health *Health) checkUpstream(ctx context.Context) error {
+	upstream := *health.options.Upstream
+	upstream.Path = strings.TrimSuffix(upstream.Path, "/") + "/-/ready"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.String(), nil)
+	if err != nil {
+		return fmt.Errorf("upstream: %w", err)
+	}
+	transport := health.options.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		// The error is not returned to the unauthenticated client
+		requestLogger(ctx).Warn("Upstream readiness check failed", "err", err)
+		return fmt.Errorf("upstream unreachable")
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream not ready: %s", resp.Status)
+	}
+	return nil
+}
+
+// loadedAt returns the time the configuration of the backend was last loaded,
+// the current time if the backend does not report it
+func loadedAt(auth Auth) time.Time {
+	if reporter, ok := auth.(LoadReporter); ok {
+		return reporter.LoadedAt()
+	}
+	return time.Now()
+}
+
+// oldest returns the oldest of the times, zero if any of them is zero
+func oldest(times ...time.Time) time.Time {
+	var result time.Time
+	for i, t := range times {
+		if t.IsZero() {
+			return time.Time{}
+		}
+		if i == 0 || t.Before(result) {
+			result = t
+		}
+	}
+	return result
+}
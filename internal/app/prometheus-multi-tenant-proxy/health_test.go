@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+)
+
+func TestHealthHandler(t *testing.T) {
+	upstreamStatus := http.StatusOK
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prometheus/-/ready" {
+			t.Errorf("Unexpected upstream path %s", r.URL.Path)
+		}
+		w.WriteHeader(upstreamStatus)
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL + "/prometheus")
+	unreachableURL, _ := url.Parse("http://127.0.0.1:1")
+
+	fresh := newBasicAuthFromConfig(&pkg.Authn{})
+	stale := newBasicAuthFromConfig(&pkg.Authn{})
+	stale.loadedAt = time.Now().Add(-2 * time.Hour)
+
+	testCases := []struct {
+		desc           string
+		auth           Auth
+		options        HealthOptions
+		upstreamStatus int
+		path           string
+		status         int
+		body           string
+	}{
+		{"healthy", stale, HealthOptions{MaxConfigAge: time.Hour}, http.StatusOK, "/-/proxy/healthy", http.StatusOK, "Healthy"},
+		{"ready", fresh, HealthOptions{MaxConfigAge: time.Hour}, http.StatusOK, "/-/proxy/ready", http.StatusOK, "Ready"},
+		{"no max age", stale, HealthOptions{}, http.StatusOK, "/-/proxy/ready", http.StatusOK, "Ready"},
+		{"stale config", stale, HealthOptions{MaxConfigAge: time.Hour}, http.StatusOK, "/-/proxy/ready", http.StatusServiceUnavailable, "auth configuration last loaded 2h0m0s ago"},
+		{"not loaded", &BasicAuth{configLock: fresh.configLock}, HealthOptions{}, http.StatusOK, "/-/proxy/ready", http.StatusServiceUnavailable, "auth configuration not loaded"},
+		{"without report", &testAuth{}, HealthOptions{MaxConfigAge: time.Hour}, http.StatusOK, "/-/proxy/ready", http.StatusOK, "Ready"},
+		{"upstream ready", fresh, HealthOptions{Upstream: upstreamURL}, http.StatusOK, "/-/proxy/ready", http.StatusOK, "Ready"},
+		{"upstream not ready", fresh, HealthOptions{Upstream: upstreamURL}, http.StatusServiceUnavailable, "/-/proxy/ready", http.StatusServiceUnavailable, "upstream not ready: 503 Service Unavailable"},
+		{"upstream unreachable", fresh, HealthOptions{Upstream: unreachableURL}, http.StatusOK, "/-/proxy/ready", http.StatusServiceUnavailable, "upstream unreachable"},
+		{"upstream not ready and healthy", fresh, HealthOptions{Upstream: upstreamURL}, http.StatusServiceUnavailable, "/-/proxy/healthy", http.StatusOK, "Healthy"},
+		{"all checks", stale, HealthOptions{MaxConfigAge: time.Hour, Upstream: upstreamURL}, http.StatusServiceUnavailable, "/-/proxy/ready", http.StatusServiceUnavailable, "last loaded 2h0m0s ago, upstream not ready"},
+		{"passthrough", stale, HealthOptions{MaxConfigAge: time.Hour}, http.StatusOK, "/-/ready", http.StatusTeapot, ""},
+		{"outside prefix", fresh, HealthOptions{}, http.StatusOK, "/foo/-/proxy/ready", http.StatusTeapot, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			upstreamStatus = tc.upstreamStatus
+			h := HealthHandler(NewHealth(tc.auth, "", tc.options), func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest("GET", tc.path, nil))
+			if w.Code != tc.status {
+				t.Errorf("Got status %d, expected %d", w.Code, tc.status)
+			}
+			if !strings.Contains(w.Body.String(), tc.body) {
+				t.Errorf("Got body %q, expected %q", w.Body.String(), tc.body)
+			}
+		})
+	}
+}
+
+func TestHealthHandler_RoutePrefix(t *testing.T) {
+	h := HealthHandler(NewHealth(&testAuth{}, "/prometheus", HealthOptions{}), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for path, status := range map[string]int{
+		"/prometheus/-/proxy/ready":   http.StatusOK,
+		"/prometheus/-/proxy/healthy": http.StatusOK,
+		"/-/proxy/ready":              http.StatusTeapot,
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s got status %d, expected %d", path, w.Code, status)
+		}
+	}
+}
+
+func TestLoadedAt(t *testing.T) {
+	now := time.Now()
+	older := newBasicAuthFromConfig(&pkg.Authn{})
+	older.loadedAt = now.Add(-time.Hour)
+	newer := newBasicAuthFromConfig(&pkg.Authn{})
+	newer.loadedAt = now
+	never := newBasicAuthFromConfig(&pkg.Authn{})
+	never.loadedAt = time.Time{}
+	policy := newPolicyAuthFromPolicy(newer, &pkg.Policy{})
+	policy.loadedAt = now.Add(-2 * time.Hour)
+
+	testCases := []struct {
+		desc     string
+		auth     Auth
+		expected time.Time
+	}{
+		{"backend", older, now.Add(-time.Hour)},
+		{"chain", NewChainAuth(newer, older), now.Add(-time.Hour)},
+		{"chain not loaded", NewChainAuth(newer, never), time.Time{}},
+		{"chain without report", NewChainAuth(&testAuth{}, older), now.Add(-time.Hour)},
+		{"policy", policy, now.Add(-2 * time.Hour)},
+		{"policy backend", newPolicyAuthFromPolicy(older, &pkg.Policy{}), now.Add(-time.Hour)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := loadedAt(tc.auth); !got.Equal(tc.expected) {
+				t.Errorf("Got %v, expected %v", got, tc.expected)
+			}
+		})
+	}
+}
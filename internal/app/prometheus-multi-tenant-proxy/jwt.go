@@ -1,17 +1,20 @@
 package proxy
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/MicahParks/keyfunc/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
 )
 
 // NamespaceClaim expected structure of the JWT token payload
@@ -20,6 +23,16 @@ type NamespaceClaim struct {
 	Namespaces []string `json:"namespaces"`
 	// Labels contains a map of labels that will be injected for the user
 	Labels map[string][]string `json:"labels"`
+	// Groups contains the list of groups the user belongs to
+	Groups []string `json:"groups"`
+	// ExcludedNamespaces contains the list of namespaces hidden from the user
+	ExcludedNamespaces []string `json:"excludedNamespaces"`
+	// ExcludedLabels contains a map of labels that will be injected as negative matchers for the user
+	ExcludedLabels map[string][]string `json:"excludedLabels"`
+	// Endpoints contains the list of endpoints the user is allowed to request
+	Endpoints []string `json:"endpoints"`
+	// Methods contains the list of HTTP methods the user is allowed to use
+	Methods []string `json:"methods"`
 	jwt.RegisteredClaims
 }
 
@@ -31,6 +44,7 @@ type JwtAuth struct {
 	b64content string
 	jwks       *keyfunc.JWKS
 	lock       *sync.RWMutex
+	loadedAt   time.Time
 }
 
 // NewJwtAuth creates a JwtAuth by loaded a JWKS from either a file or an URL
@@ -45,7 +59,7 @@ func NewJwtAuth(config string) *JwtAuth {
 		auth.isFile = false
 	}
 	if !auth.Load() {
-		log.Fatal("Could not initialize JWT authentication.")
+		fatal("Could not initialize JWT authentication")
 	}
 	return auth
 }
@@ -54,11 +68,12 @@ func newJwtAuthFromString(jwksJSON string) *JwtAuth {
 	// ! the Load() method cannot be used.
 	jwks, err := keyfunc.NewJSON(json.RawMessage(jwksJSON))
 	if err != nil {
-		log.Fatalf("Could not load JWKS: %v", err)
+		fatal("Could not load JWKS", "err", err)
 	}
 	return &JwtAuth{
-		jwks: jwks,
-		lock: new(sync.RWMutex),
+		jwks:     jwks,
+		lock:     new(sync.RWMutex),
+		loadedAt: time.Now(),
 	}
 }
 
@@ -74,7 +89,7 @@ func (auth *JwtAuth) String() string {
 // Load loads or reloads the JWKS from its config location (file or URL).
 func (auth *JwtAuth) Load() bool {
 	if auth.config == "" {
-		log.Fatalf("JWTAuth: Load() cannot be called without a config")
+		fatal("JWTAuth: Load() cannot be called without a config")
 	}
 
 	if auth.isFile {
@@ -89,17 +104,19 @@ func (auth *JwtAuth) loadFromURL(url *string) bool {
 	// to avoid getting the lock unless strictly necessary.
 	jwks, err := keyfunc.Get(*url, keyfunc.Options{})
 	if err != nil {
-		log.Printf("Failed to get the JWKS from the given URL: %s", err)
+		slog.Error("Failed to get the JWKS from the given URL", "err", err)
 		return false
 	}
 	b64content := base64.StdEncoding.EncodeToString(jwks.RawJWKS())
 
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	// The JWKS is fresh even if unchanged
+	auth.loadedAt = time.Now()
 	if auth.jwks == nil || b64content != auth.b64content {
-		auth.lock.RLock()
-		defer auth.lock.RUnlock()
 		auth.jwks = jwks
 		auth.b64content = b64content
-		log.Printf("Reloaded JWKS from URL: %s", *url)
+		slog.Info("Reloaded JWKS from URL", "url", *url)
 	}
 	return true
 }
@@ -107,60 +124,95 @@ func (auth *JwtAuth) loadFromURL(url *string) bool {
 func (auth *JwtAuth) loadFromFile(location *string) bool {
 	content, err := os.ReadFile(*location)
 	if err != nil {
-		log.Printf("Failed to read JWKS file: %v", err)
+		slog.Error("Failed to read JWKS file", "err", err)
 		return false
 	}
 	b64content := base64.StdEncoding.EncodeToString(content)
 	if auth.b64content == b64content {
 		// nothing to do
+		auth.lock.Lock()
+		auth.loadedAt = time.Now()
+		auth.lock.Unlock()
 		return true
 	}
 
 	jwks, err := keyfunc.NewJSON(json.RawMessage(content))
 	if err != nil {
-		log.Printf("Failed to parse JWKS file: %v", err)
+		slog.Error("Failed to parse JWKS file", "err", err)
 		return false
 	}
-	auth.lock.RLock()
-	defer auth.lock.RUnlock()
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
 	auth.b64content = b64content
 	auth.jwks = jwks
-	log.Print("Reloaded JWKS from file")
+	auth.loadedAt = time.Now()
+	slog.Info("Reloaded JWKS from file")
 	return true
 }
 
+// LoadedAt returns the time the JWKS was last loaded, or found unchanged
+func (auth *JwtAuth) LoadedAt() time.Time {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
+	return auth.loadedAt
+}
+
 // IsAuthorized validates the user by verifying the JWT token in
 // the request and returning the namespaces claim found in token the payload.
-func (auth *JwtAuth) IsAuthorized(r *http.Request) (bool, []string, map[string][]string) {
+func (auth *JwtAuth) IsAuthorized(r *http.Request) (*Identity, error) {
 	tokenString := extractTokens(&r.Header)
 	if tokenString == "" {
-		log.Printf("Token is missing from header request")
-		return false, nil, nil
+		requestLogger(r.Context()).Debug("Token is missing from header request")
+		return nil, errMissingCredentials
 	}
-	return auth.isAuthorized(tokenString)
+	return auth.isAuthorized(r.Context(), tokenString)
 }
 
-// WriteUnauthorisedResponse writes a 401 Unauthorized HTTP response
-func (auth *JwtAuth) WriteUnauthorisedResponse(w http.ResponseWriter) {
-	w.WriteHeader(401)
-	w.Write([]byte("Unauthorised\n"))
+// Recognizes returns true if the request carries a token
+func (auth *JwtAuth) Recognizes(r *http.Request) bool {
+	return extractTokens(&r.Header) != ""
 }
 
-func (auth *JwtAuth) isAuthorized(tokenString string) (bool, []string, map[string][]string) {
+// WriteUnauthorisedResponse writes the error HTTP response, with
+// a bearer token challenge if the user is not authenticated
+func (auth *JwtAuth) WriteUnauthorisedResponse(w http.ResponseWriter, err error) {
+	writeAuthError(w, auth.Challenges(), err)
+}
+
+// Challenges returns the bearer token challenge
+func (auth *JwtAuth) Challenges() []string {
+	return []string{`Bearer realm="` + realm + `"`}
+}
+
+func (auth *JwtAuth) isAuthorized(ctx context.Context, tokenString string) (*Identity, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &NamespaceClaim{}, auth.jwks.Keyfunc)
 	if err != nil || !token.Valid {
-		log.Printf("%s\n", err)
-		return false, nil, nil
+		requestLogger(ctx).Warn("Invalid token", "err", err)
+		return nil, errInvalidCredentials
 	}
 
 	claims := token.Claims.(*NamespaceClaim)
+	if err := pkg.ValidateScope(claims.Namespaces, claims.Labels, claims.ExcludedNamespaces, claims.ExcludedLabels); err != nil {
+		requestLogger(ctx).Warn("Invalid token claims", "err", err)
+		return nil, errInvalidCredentials
+	}
 	if claims.Namespaces == nil {
 		claims.Namespaces = []string{}
 	}
 	if claims.Labels == nil {
 		claims.Labels = make(map[string][]string)
 	}
-	return true, claims.Namespaces, claims.Labels
+	return &Identity{
+		Name:       claims.Subject,
+		Groups:     claims.Groups,
+		Namespaces: claims.Namespaces,
+		Labels:     claims.Labels,
+
+		ExcludedNamespaces: claims.ExcludedNamespaces,
+		ExcludedLabels:     claims.ExcludedLabels,
+		Endpoints:          claims.Endpoints,
+		Methods:            claims.Methods,
+	}, nil
 }
 
 func extractTokens(headers *http.Header) string {
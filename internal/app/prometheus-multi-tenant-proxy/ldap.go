@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// ldapClient is the subset of the LDAP connection used by LDAPAuth
+type ldapClient interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+type ldapCacheEntry struct {
+	identity   *Identity
+	expiration time.Time
+}
+
+// LDAPAuth can be used as a middleware chain to authenticate users
+// with Basic authentication against an LDAP server before proxying a request.
+// The namespaces and labels are granted through the LDAP groups of the user.
+type LDAPAuth struct {
+	configLocation string
+	config         *pkg.LDAPConfig
+	configLock     *sync.RWMutex
+	loadedAt       time.Time
+	dial           func(config *pkg.LDAPConfig) (ldapClient, error)
+	cache          map[[sha256.Size]byte]ldapCacheEntry
+	cacheLock      *sync.Mutex
+}
+
+// NewLDAPAuth creates a LDAPAuth, loading the LDAPConfig from configLocation
+func NewLDAPAuth(configLocation string) *LDAPAuth {
+	auth := &LDAPAuth{
+		configLocation: configLocation,
+		configLock:     new(sync.RWMutex),
+		dial:           dialLDAP,
+		cache:          make(map[[sha256.Size]byte]ldapCacheEntry),
+		cacheLock:      new(sync.Mutex),
+	}
+	if !auth.Load() {
+		os.Exit(1)
+	}
+	return auth
+}
+
+func newLDAPAuthFromConfig(config *pkg.LDAPConfig, dial func(config *pkg.LDAPConfig) (ldapClient, error)) *LDAPAuth {
+	// Load cannot be called!
+	return &LDAPAuth{
+		config:     config,
+		configLock: new(sync.RWMutex),
+		loadedAt:   time.Now(),
+		dial:       dial,
+		cache:      make(map[[sha256.Size]byte]ldapCacheEntry),
+		cacheLock:  new(sync.Mutex),
+	}
+}
+
+// Load loads or reload the LDAPConfig from the configuration file
+func (auth *LDAPAuth) Load() bool {
+	temp, err := pkg.ParseLDAPConfig(&auth.configLocation)
+	if err != nil {
+		slog.Error("Could not parse LDAP config file", "file", auth.configLocation, "err", err)
+		return false
+	}
+	auth.configLock.Lock()
+	auth.config = temp
+	auth.loadedAt = time.Now()
+	auth.configLock.Unlock()
+	// The cached identities may be granted other namespaces by the new configuration,
+	// clearing the cache also drops the expired entries
+	auth.cacheLock.Lock()
+	auth.cache = make(map[[sha256.Size]byte]ldapCacheEntry)
+	auth.cacheLock.Unlock()
+	slog.Info("Reloaded LDAP configuration from file", "file", auth.configLocation)
+	return true
+}
+
+// LoadedAt returns the time the LDAPConfig was last loaded
+func (auth *LDAPAuth) LoadedAt() time.Time {
+	auth.configLock.RLock()
+	defer auth.configLock.RUnlock()
+	return auth.loadedAt
+}
+
+// Recognizes returns true if the request uses basic authentication
+func (auth *LDAPAuth) Recognizes(r *http.Request) bool {
+	_, _, ok := r.BasicAuth()
+	return ok
+}
+
+// IsAuthorized binds to the LDAP server with the basic authentication credentials
+// and returns the namespaces and labels granted to the groups of the user
+func (auth *LDAPAuth) IsAuthorized(r *http.Request) (*Identity, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, errMissingCredentials
+	}
+	return auth.isAuthorized(r.Context(), user, pass)
+}
+
+// WriteUnauthorisedResponse writes the error HTTP response, with
+// a redirect to basic authentication if the user is not authenticated
+func (auth *LDAPAuth) WriteUnauthorisedResponse(w http.ResponseWriter, err error) {
+	writeAuthError(w, auth.Challenges(), err)
+}
+
+// Challenges returns the basic authentication challenge
+func (auth *LDAPAuth) Challenges() []string {
+	return []string{`Basic realm="` + realm + `"`}
+}
+
+func (auth *LDAPAuth) isAuthorized(ctx context.Context, user, pass string) (*Identity, error) {
+	if user == "" || pass == "" {
+		// An empty password would result in an unauthenticated bind, which always succeeds
+		return nil, errInvalidCredentials
+	}
+
+	cacheKey := sha256.Sum256([]byte(user + "\x00" + pass))
+	auth.cacheLock.Lock()
+	entry, found := auth.cache[cacheKey]
+	if found && !time.Now().Before(entry.expiration) {
+		delete(auth.cache, cacheKey)
+		found = false
+	}
+	auth.cacheLock.Unlock()
+	if found {
+		return entry.identity, nil
+	}
+
+	config := auth.getConfig()
+	groups, err := auth.authenticate(config, user, pass)
+	if err != nil {
+		// Server errors are not cached
+		requestLogger(ctx).Error("LDAP authentication failed", "user", user, "err", err)
+		return nil, errAuthUnavailable
+	}
+
+	if groups == nil {
+		// Failed logins are not cached, so that guessing passwords cannot fill the cache
+		return nil, errInvalidCredentials
+	}
+
+	identity := mapLDAPGroups(config.Groups, groups)
+	identity.Name = user
+	identity.Groups = groups
+	auth.cacheLock.Lock()
+	auth.cache[cacheKey] = ldapCacheEntry{
+		identity:   identity,
+		expiration: time.Now().Add(config.CacheTTL),
+	}
+	auth.cacheLock.Unlock()
+	return identity, nil
+}
+
+// authenticate binds as the user and returns its groups. The returned groups
+// are nil if the credentials are invalid, and an error is only returned
+// if the LDAP server could not be queried.
+func (auth *LDAPAuth) authenticate(config *pkg.LDAPConfig, user, pass string) ([]string, error) {
+	conn, err := auth.dial(config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := auth.bindService(conn, config); err != nil {
+		return nil, err
+	}
+	users, err := conn.Search(ldap.NewSearchRequest(
+		config.UserSearch.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(config.UserSearch.Filter, ldap.EscapeFilter(user)),
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(users.Entries) != 1 {
+		// Unknown or ambiguous user
+		return nil, nil
+	}
+	userDN := users.Entries[0].DN
+
+	if err := conn.Bind(userDN, pass); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Search the groups with the service account, if any
+	if err := auth.bindService(conn, config); err != nil {
+		return nil, err
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		config.GroupSearch.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(config.GroupSearch.Filter, ldap.EscapeFilter(userDN)),
+		[]string{config.GroupSearch.Attribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		if name := entry.GetAttributeValue(config.GroupSearch.Attribute); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+func (auth *LDAPAuth) bindService(conn ldapClient, config *pkg.LDAPConfig) error {
+	if config.BindDN == "" {
+		return nil
+	}
+	return conn.Bind(config.BindDN, config.BindPassword)
+}
+
+func (auth *LDAPAuth) getConfig() *pkg.LDAPConfig {
+	auth.configLock.RLock()
+	defer auth.configLock.RUnlock()
+	return auth.config
+}
+
+// mapLDAPGroups returns an identity with the union of the namespaces and labels granted to the given groups,
+// and their most permissive rate and query limits
+func mapLDAPGroups(mappings []pkg.Group, groups []string) *Identity {
+	identity := &Identity{
+		Namespaces: make([]string, 0),
+		Labels:     make(map[string][]string),
+	}
+	var queryLimits []*pkg.QueryLimits
+	for _, mapping := range mappings {
+		for _, group := range groups {
+			if mapping.Name != group {
+				continue
+			}
+			identity.Namespaces = append(identity.Namespaces, mapping.Namespaces...)
+			for k, v := range mapping.Labels {
+				identity.Labels[k] = append(identity.Labels[k], v...)
+			}
+			identity.ExcludedNamespaces = append(identity.ExcludedNamespaces, mapping.ExcludedNamespaces...)
+			for k, v := range mapping.ExcludedLabels {
+				if identity.ExcludedLabels == nil {
+					identity.ExcludedLabels = make(map[string][]string)
+				}
+				identity.ExcludedLabels[k] = append(identity.ExcludedLabels[k], v...)
+			}
+			identity.RateLimit = pkg.MaxRateLimit(identity.RateLimit, mapping.RateLimit)
+			queryLimits = append(queryLimits, mapping.QueryLimits)
+		}
+	}
+	identity.QueryLimits = pkg.MergeQueryLimits(queryLimits...)
+	return identity
+}
+
+func dialLDAP(config *pkg.LDAPConfig) (ldapClient, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+)
+
+// fakeDirectory is an in-process LDAP stand-in supporting
+// simple binds and equality filters such as (uid=foo)
+type fakeDirectory struct {
+	passwords map[string]string
+	entries   []*ldap.Entry
+	down      bool
+	dials     int
+}
+
+func (d *fakeDirectory) dial(config *pkg.LDAPConfig) (ldapClient, error) {
+	d.dials++
+	if d.down {
+		return nil, errors.New("connection refused")
+	}
+	return &fakeConn{directory: d}, nil
+}
+
+type fakeConn struct {
+	directory *fakeDirectory
+}
+
+func (c *fakeConn) Bind(username, password string) error {
+	if expected, ok := c.directory.passwords[username]; !ok || expected != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func (c *fakeConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	attr, value, _ := strings.Cut(strings.Trim(req.Filter, "()"), "=")
+	result := &ldap.SearchResult{}
+	for _, entry := range c.directory.entries {
+		if !strings.HasSuffix(entry.DN, req.BaseDN) {
+			continue
+		}
+		for _, v := range entry.GetAttributeValues(attr) {
+			if v == value {
+				result.Entries = append(result.Entries, entry)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func newTestLDAPAuth() (*LDAPAuth, *fakeDirectory) {
+	directory := &fakeDirectory{
+		passwords: map[string]string{
+			"cn=proxy,dc=example,dc=com":            "service",
+			"uid=alice,ou=people,dc=example,dc=com": "alice-pass",
+			"uid=bob,ou=people,dc=example,dc=com":   "bob-pass",
+		},
+		entries: []*ldap.Entry{
+			ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{"uid": {"alice"}}),
+			ldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{"uid": {"bob"}}),
+			ldap.NewEntry("cn=team-a,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn":     {"team-a"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com"},
+			}),
+			ldap.NewEntry("cn=team-b,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn":     {"team-b"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+			}),
+		},
+	}
+	config := &pkg.LDAPConfig{
+		URL:          "ldap://fake",
+		BindDN:       "cn=proxy,dc=example,dc=com",
+		BindPassword: "service",
+		UserSearch:   pkg.LDAPSearch{BaseDN: "ou=people,dc=example,dc=com", Filter: "(uid=%s)"},
+		GroupSearch:  pkg.LDAPSearch{BaseDN: "ou=groups,dc=example,dc=com", Filter: "(member=%s)", Attribute: "cn"},
+		CacheTTL:     time.Minute,
+		Groups: []pkg.Group{
+			{Name: "team-a", Namespaces: []string{"tenant-a"}, Labels: map[string][]string{}},
+			{Name: "team-b", Namespaces: []string{"tenant-b"}, Labels: map[string][]string{"app": {"shop"}}},
+		},
+	}
+	return newLDAPAuthFromConfig(config, directory.dial), directory
+}
+
+func TestLDAP_isAuthorized(t *testing.T) {
+	auth, _ := newTestLDAPAuth()
+
+	testCases := []struct {
+		desc       string
+		user       string
+		pass       string
+		authorized bool
+		ns         []string
+		labels     map[string][]string
+	}{
+		{"two groups", "alice", "alice-pass", true, []string{"tenant-a", "tenant-b"}, map[string][]string{"app": {"shop"}}},
+		{"one group", "bob", "bob-pass", true, []string{"tenant-b"}, map[string][]string{"app": {"shop"}}},
+		{"wrong password", "alice", "bob-pass", false, nil, nil},
+		{"empty password", "alice", "", false, nil, nil},
+		{"unknown user", "carol", "alice-pass", false, nil, nil},
+		{"filter injection", "*", "alice-pass", false, nil, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			identity, err := auth.isAuthorized(context.Background(), tc.user, tc.pass)
+			authorized := err == nil
+			if authorized != tc.authorized {
+				t.Fatalf("authorized=%v, expected=%v", authorized, tc.authorized)
+			}
+			if !authorized {
+				return
+			}
+			if identity.Name != tc.user {
+				t.Errorf("Got unexpected name: %v", identity.Name)
+			}
+			if !reflect.DeepEqual(identity.Namespaces, tc.ns) {
+				t.Errorf("Got unexpected namespaces: %v", identity.Namespaces)
+			}
+			if !reflect.DeepEqual(identity.Labels, tc.labels) {
+				t.Errorf("Got unexpected labels: %v", identity.Labels)
+			}
+		})
+	}
+}
+
+func TestLDAP_Cache(t *testing.T) {
+	auth, directory := newTestLDAPAuth()
+
+	if _, err := auth.isAuthorized(context.Background(), "bob", "bob-pass"); err != nil {
+		t.Fatal("Should be authorized")
+	}
+	// Cached results are used while the LDAP server is down
+	directory.down = true
+	if _, err := auth.isAuthorized(context.Background(), "bob", "bob-pass"); err != nil {
+		t.Error("Should be authorized from cache")
+	}
+	if directory.dials != 1 {
+		t.Errorf("Expected a single dial, got %d", directory.dials)
+	}
+	// Expired results are not used anymore
+	auth.config.CacheTTL = -time.Second
+	auth.cache = map[[32]byte]ldapCacheEntry{}
+	auth.isAuthorized(context.Background(), "bob", "bob-pass")
+	if _, err := auth.isAuthorized(context.Background(), "bob", "bob-pass"); err != errAuthUnavailable {
+		t.Errorf("Should be unavailable when the cache expired and LDAP is down, got %v", err)
+	}
+	if len(auth.cache) != 0 {
+		t.Errorf("Expired entries should be removed, got %d", len(auth.cache))
+	}
+}
+
+func TestLDAP_CacheFailedLogins(t *testing.T) {
+	auth, directory := newTestLDAPAuth()
+
+	for i := 0; i < 3; i++ {
+		if _, err := auth.isAuthorized(context.Background(), "bob", fmt.Sprintf("guess-%d", i)); err != errInvalidCredentials {
+			t.Fatalf("Should not be authorized, got %v", err)
+		}
+	}
+	if len(auth.cache) != 0 {
+		t.Errorf("Failed logins should not be cached, got %d entries", len(auth.cache))
+	}
+	if directory.dials != 3 {
+		t.Errorf("Expected a dial per failed login, got %d", directory.dials)
+	}
+}
@@ -1,14 +1,83 @@
 package proxy
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
-// LogRequest can be used as a middleware chain to log every request before proxying the request
+// NewLogger creates a logger writing to w with the given format (logfmt or json), at or above the given level.
+// The logged values are redacted by the redactor, if any
+func NewLogger(w io.Writer, format, level string, redactor *Redactor) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q, must be one of: debug, info, warn, error", level)
+	}
+	options := &slog.HandlerOptions{Level: l}
+	if redactor != nil {
+		options.ReplaceAttr = redactor.ReplaceAttr
+	}
+	switch format {
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, must be one of: logfmt, json", format)
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestLogger returns the logger of the request, with its request id and user, or the default logger
+func requestLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// withLogger returns a copy of the request with a logger adding the given attributes to the ones of the request
+func withLogger(r *http.Request, args ...any) *http.Request {
+	logger := requestLogger(r.Context()).With(args...)
+	return r.WithContext(context.WithValue(r.Context(), loggerKey, logger))
+}
+
+// LogRequest can be used as a middleware chain to log every request once served.
+// The logger of the request, available to the inner handlers, identifies the request
+// with the id set by RequestIDHandler and the trace id, if any
 func LogRequest(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[FROM]\t%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
-		handler(w, r)
+		start := time.Now()
+		var attrs []any
+		if id := requestID(r.Context()); id != "" {
+			attrs = append(attrs, "request_id", id)
+		}
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+			attrs = append(attrs, "trace_id", spanContext.TraceID().String())
+		}
+		r = withLogger(r, attrs...)
+		r, m := withRequestMetrics(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+
+		requestLogger(r.Context()).Info("request served",
+			"remote_addr", r.RemoteAddr,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"endpoint", endpointLabel(r.URL.Path),
+			"status", recorder.statusCode(),
+			"duration", time.Since(start),
+			"user", m.user,
+		)
 	}
 }
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogging_NewLogger(t *testing.T) {
+	testCases := []struct {
+		format   string
+		level    string
+		ok       bool
+		expected string
+	}{
+		{"logfmt", "info", true, `level=INFO msg=hello key=value`},
+		{"json", "info", true, `"msg":"hello","key":"value"`},
+		{"json", "error", true, ``},
+		{"json", "DEBUG", true, `"msg":"hello"`},
+		{"xml", "info", false, ``},
+		{"logfmt", "verbose", false, ``},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.format+"/"+tc.level, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := NewLogger(&buf, tc.format, tc.level, nil)
+			if (err == nil) != tc.ok {
+				t.Fatalf("NewLogger() error = %v, expected ok=%v", err, tc.ok)
+			}
+			if !tc.ok {
+				return
+			}
+			logger.Info("hello", "key", "value")
+			if !strings.Contains(buf.String(), tc.expected) || (tc.expected == "") != (buf.Len() == 0) {
+				t.Errorf("Unexpected log %q, expected %q", buf.String(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestLogging_LogRequest(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := NewLogger(&buf, "json", "debug", NewRedactor(nil))
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(defaultLogger)
+
+	auth := &testAuth{authorized: true, namespaces: []string{"ns1"}}
+	handler := RequestIDHandler(LogRequest(AuthHandler(auth, nil, func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r.Context()).Debug("inner")
+		w.WriteHeader(http.StatusAccepted)
+	})))
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	handler(httptest.NewRecorder(), r)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d: %s", len(lines), buf.String())
+	}
+	var inner, served map[string]any
+	_ = json.Unmarshal([]byte(lines[0]), &inner)
+	_ = json.Unmarshal([]byte(lines[1]), &served)
+	if inner["request_id"] != "abc" || inner["user"] != "test" || inner["tenant"] == nil {
+		t.Errorf("Inner handlers should log the request id, user and tenant: %s", lines[0])
+	}
+	if served["request_id"] != "abc" || served["user"] != "test" || served["status"] != float64(http.StatusAccepted) ||
+		served["endpoint"] != "/api/v1/query" || served["duration"] == nil {
+		t.Errorf("Served request not logged with the expected fields: %s", lines[1])
+	}
+}
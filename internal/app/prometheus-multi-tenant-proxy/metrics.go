@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const metricsNamespace = "prometheus_multi_tenant_proxy"
+
+var (
+	// registry holds the metrics of the proxy
+	registry = prometheus.NewRegistry()
+
+	requests = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests served by the proxy, by endpoint, status code and user.",
+	}, []string{"endpoint", "code", "user"})
+
+	requestDuration = promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests served by the proxy, by endpoint, status code and user.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "code", "user"})
+
+	authRequests = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_requests_total",
+		Help:      "Outcomes of the authentication and authorization of the requests, by backend and reason.",
+	}, []string{"backend", "reason"})
+
+	rejectedQueries = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rejected_queries_total",
+		Help:      "Queries not forwarded to Prometheus, because they exceed the query limits (limit) or could not be rewritten (invalid).",
+	}, []string{"reason"})
+
+	upstreamErrors = promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Requests that could not be forwarded to Prometheus.",
+	})
+
+	configReloads = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Reloads of the configuration, by result (success or failure).",
+	}, []string{"result"})
+
+	configLastReloadSuccess = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful load of the configuration.",
+	})
+
+	rateLimitedRequests = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected because the user exceeded its rate limit.",
+	}, []string{"user"})
+
+	concurrencyLimitedRequests = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "concurrency_limited_requests_total",
+		Help:      "Requests rejected because too many requests were in flight, by exceeded limit (user or global).",
+	}, []string{"limit"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// endpoints are the Prometheus API endpoints labelling the request metrics,
+// all the other paths are counted as "other" to bound the cardinality
+var endpoints = []string{
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/query_exemplars",
+	"/api/v1/format_query",
+	"/api/v1/series",
+	"/api/v1/labels",
+	"/api/v1/metadata",
+	"/api/v1/targets",
+	"/api/v1/targets/metadata",
+	"/api/v1/rules",
+	"/api/v1/alerts",
+	"/api/v1/alertmanagers",
+	"/api/v1/read",
+	"/api/v1/write",
+	"/federate",
+}
+
+// MetricsHandler serves the metrics of the proxy
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// requestMetrics holds the labels of a request only known by the inner handlers, shared with the logs
+type requestMetrics struct {
+	user string
+}
+
+// withRequestMetrics returns the request with the labels shared by the outer handlers, adding them if missing
+func withRequestMetrics(r *http.Request) (*http.Request, *requestMetrics) {
+	if m, ok := r.Context().Value(metricsKey).(*requestMetrics); ok {
+		return r, m
+	}
+	m := &requestMetrics{}
+	return r.WithContext(context.WithValue(r.Context(), metricsKey, m)), m
+}
+
+// statusRecorder records the status code and the size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// statusCode returns the status code of the response, 200 OK if nothing was written
+func (w *statusRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap allows http.ResponseController to flush the streamed responses
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// InstrumentRequest can be used as a middleware chain to count the requests and measure their latency
+func InstrumentRequest(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, m := withRequestMetrics(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+
+		labels := prometheus.Labels{"endpoint": endpointLabel(r.URL.Path), "code": strconv.Itoa(recorder.statusCode()), "user": m.user}
+		requests.With(labels).Inc()
+		requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+}
+
+// endpointLabel returns the Prometheus API endpoint of the path, ignoring the route prefix
+func endpointLabel(p string) string {
+	if isLabelsPath(p) && !strings.HasSuffix(p, "/api/v1/labels") {
+		return "/api/v1/label/:name/values"
+	}
+	for _, endpoint := range endpoints {
+		if strings.HasSuffix(p, endpoint) {
+			return endpoint
+		}
+	}
+	return "other"
+}
+
+// observeAuth counts the outcome of the authentication and authorization of a request,
+// and records it in its span and in the audit log with the identity of the user if authenticated
+func observeAuth(auth Auth, r *http.Request, identity *Identity, err error) {
+	backend, reason := authBackend(auth, r), authReason(err)
+	authRequests.WithLabelValues(backend, reason).Inc()
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("auth.backend", backend),
+		attribute.String("auth.result", reason),
+	)
+	auditRecord(r.Context()).setIdentity(identity, backend, err)
+}
+
+// authBackend returns the name of the backend authenticating the request
+func authBackend(auth Auth, r *http.Request) string {
+	switch a := auth.(type) {
+	case *BasicAuth:
+		return "basic"
+	case *JwtAuth:
+		return "jwt"
+	case *LDAPAuth:
+		return "ldap"
+	case *PolicyAuth:
+		return authBackend(a.Auth, r)
+	case *ChainAuth:
+		if found := a.find(r); found != nil {
+			return authBackend(found, r)
+		}
+		return "none"
+	}
+	return "unknown"
+}
+
+// authReason returns the reason of an authentication or authorization outcome
+func authReason(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, errMissingCredentials):
+		return "missing_credentials"
+	case errors.Is(err, errInvalidCredentials):
+		return "invalid_credentials"
+	case errors.Is(err, errAuthUnavailable):
+		return "unavailable"
+	case errors.Is(err, errNoScope):
+		return "no_scope"
+	case errors.Is(err, errEndpointForbidden):
+		return "endpoint_forbidden"
+	case errors.Is(err, errMethodForbidden):
+		return "method_forbidden"
+	}
+	return "other"
+}
+
+// observeReload counts a reload of the configuration
+func observeReload(ok bool) {
+	if !ok {
+		configReloads.WithLabelValues("failure").Inc()
+		return
+	}
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccess.SetToCurrentTime()
+}
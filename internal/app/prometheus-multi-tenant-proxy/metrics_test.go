@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_endpointLabel(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/v1/query", "/api/v1/query"},
+		{"/api/v1/query_range", "/api/v1/query_range"},
+		{"/prometheus/api/v1/series", "/api/v1/series"},
+		{"/api/v1/labels", "/api/v1/labels"},
+		{"/api/v1/label/job/values", "/api/v1/label/:name/values"},
+		{"/federate", "/federate"},
+		{"/api/v1/unknown", "other"},
+		{"/random/path/123", "other"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			if got := endpointLabel(tc.path); got != tc.expected {
+				t.Errorf("endpointLabel() = %s, expected %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestMetrics_authReason(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{nil, "success"},
+		{errMissingCredentials, "missing_credentials"},
+		{fmt.Errorf("wrapped: %w", errInvalidCredentials), "invalid_credentials"},
+		{errAuthUnavailable, "unavailable"},
+		{errNoScope, "no_scope"},
+		{errEndpointForbidden, "endpoint_forbidden"},
+		{errMethodForbidden, "method_forbidden"},
+		{fmt.Errorf("boom"), "other"},
+	}
+
+	for _, tc := range testCases {
+		if got := authReason(tc.err); got != tc.expected {
+			t.Errorf("authReason(%v) = %s, expected %s", tc.err, got, tc.expected)
+		}
+	}
+}
+
+func TestMetrics_authBackend(t *testing.T) {
+	basic := newBasicAuthFromConfig(&pkg.Authn{Users: []pkg.User{{Username: "user", Password: "password"}}})
+	jwt := &JwtAuth{}
+	chain := NewChainAuth(jwt, basic)
+	policy := newPolicyAuthFromPolicy(chain, &pkg.Policy{})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	if got := authBackend(policy, r); got != "none" {
+		t.Errorf("Requests without credentials should not be attributed to a backend, got %s", got)
+	}
+	r.SetBasicAuth("user", "password")
+	if got := authBackend(policy, r); got != "basic" {
+		t.Errorf("authBackend() = %s, expected basic", got)
+	}
+	if got := authBackend(&testAuth{}, r); got != "unknown" {
+		t.Errorf("authBackend() = %s, expected unknown", got)
+	}
+}
+
+func TestMetrics_InstrumentRequest(t *testing.T) {
+	auth := &testAuth{authorized: true, namespaces: []string{"ns1"}}
+	handler := InstrumentRequest(AuthHandler(auth, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	before := testutil.ToFloat64(requests.WithLabelValues("/api/v1/query", "418", "test"))
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	handler(httptest.NewRecorder(), r)
+	if count := testutil.ToFloat64(requests.WithLabelValues("/api/v1/query", "418", "test")); count != before+1 {
+		t.Errorf("Request should be counted with the user, got %v", count-before)
+	}
+
+	auth.authorized = false
+	before = testutil.ToFloat64(requests.WithLabelValues("/api/v1/query", "401", ""))
+	handler(httptest.NewRecorder(), r)
+	if count := testutil.ToFloat64(requests.WithLabelValues("/api/v1/query", "401", "")); count != before+1 {
+		t.Errorf("Denied request should be counted without user, got %v", count-before)
+	}
+	if count := testutil.ToFloat64(authRequests.WithLabelValues("unknown", "invalid_credentials")); count < 1 {
+		t.Errorf("Auth outcome should be counted")
+	}
+}
+
+func TestMetrics_MetricsHandler(t *testing.T) {
+	observeReload(true)
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := w.Body.String()
+	for _, name := range []string{
+		"prometheus_multi_tenant_proxy_config_reloads_total",
+		"prometheus_multi_tenant_proxy_config_last_reload_success_timestamp_seconds",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, name) {
+			t.Errorf("Metric %s not exposed", name)
+		}
+	}
+}
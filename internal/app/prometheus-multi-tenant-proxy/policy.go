@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+)
+
+// PolicyAuth authenticates users with another Auth backend, and then
+// grants them the namespaces, labels and endpoints of a Policy.
+// The scope provided by the backend is ignored: users and groups
+// not matching any rule of the policy have access to nothing.
+type PolicyAuth struct {
+	Auth
+	policyLocation string
+	policy         *pkg.Policy
+	policyLock     *sync.RWMutex
+	loadedAt       time.Time
+}
+
+// NewPolicyAuth creates a PolicyAuth, loading the Policy from policyLocation
+func NewPolicyAuth(auth Auth, policyLocation string) *PolicyAuth {
+	policyAuth := &PolicyAuth{
+		Auth:           auth,
+		policyLocation: policyLocation,
+		policyLock:     new(sync.RWMutex),
+	}
+	if !policyAuth.loadPolicy() {
+		fatal("Could not initialize the authorization policy")
+	}
+	return policyAuth
+}
+
+func newPolicyAuthFromPolicy(auth Auth, policy *pkg.Policy) *PolicyAuth {
+	// Load cannot be called!
+	return &PolicyAuth{
+		Auth:       auth,
+		policy:     policy,
+		policyLock: new(sync.RWMutex),
+		loadedAt:   time.Now(),
+	}
+}
+
+// Load loads or reloads both the configuration of the backend and the policy
+func (auth *PolicyAuth) Load() bool {
+	ok := auth.Auth.Load()
+	return auth.loadPolicy() && ok
+}
+
+func (auth *PolicyAuth) loadPolicy() bool {
+	temp, err := pkg.ParsePolicy(&auth.policyLocation)
+	if err != nil {
+		slog.Error("Could not parse policy file", "file", auth.policyLocation, "err", err)
+		return false
+	}
+	auth.policyLock.Lock()
+	auth.policy = temp
+	auth.loadedAt = time.Now()
+	auth.policyLock.Unlock()
+	slog.Info("Reloaded authorization policy from file", "file", auth.policyLocation)
+	return true
+}
+
+// LoadedAt returns the oldest of the times the policy and the configuration of the backend were last loaded
+func (auth *PolicyAuth) LoadedAt() time.Time {
+	auth.policyLock.RLock()
+	defer auth.policyLock.RUnlock()
+	return oldest(auth.loadedAt, loadedAt(auth.Auth))
+}
+
+// IsAuthorized authenticates the user with the backend and returns
+// its identity with the scope granted by the policy
+func (auth *PolicyAuth) IsAuthorized(r *http.Request) (*Identity, error) {
+	identity, err := auth.Auth.IsAuthorized(r)
+	if err != nil {
+		return nil, err
+	}
+	return auth.evaluate(identity), nil
+}
+
+// Challenges returns the WWW-Authenticate challenges of the backend
+func (auth *PolicyAuth) Challenges() []string {
+	if c, ok := auth.Auth.(Challenger); ok {
+		return c.Challenges()
+	}
+	return nil
+}
+
+func (auth *PolicyAuth) evaluate(identity *Identity) *Identity {
+	granted := &Identity{
+		Name:       identity.Name,
+		Groups:     identity.Groups,
+		Namespaces: []string{},
+		Labels:     map[string][]string{},
+	}
+	allEndpoints, allMethods := false, false
+	var queryLimits []*pkg.QueryLimits
+	for _, rule := range auth.getPolicy().Rules {
+		if !ruleMatches(&rule, identity) {
+			continue
+		}
+		granted.Namespaces = append(granted.Namespaces, rule.Namespaces...)
+		for k, v := range rule.Labels {
+			granted.Labels[k] = append(granted.Labels[k], v...)
+		}
+		granted.ExcludedNamespaces = append(granted.ExcludedNamespaces, rule.ExcludedNamespaces...)
+		for k, v := range rule.ExcludedLabels {
+			if granted.ExcludedLabels == nil {
+				granted.ExcludedLabels = map[string][]string{}
+			}
+			granted.ExcludedLabels[k] = append(granted.ExcludedLabels[k], v...)
+		}
+		if len(rule.Endpoints) == 0 {
+			allEndpoints = true
+		}
+		granted.Endpoints = append(granted.Endpoints, rule.Endpoints...)
+		if len(rule.Methods) == 0 {
+			allMethods = true
+		}
+		granted.Methods = append(granted.Methods, rule.Methods...)
+		granted.RateLimit = pkg.MaxRateLimit(granted.RateLimit, rule.RateLimit)
+		queryLimits = append(queryLimits, rule.QueryLimits)
+	}
+	// A rule without query limits lifts them
+	granted.QueryLimits = pkg.MergeQueryLimits(queryLimits...)
+	// A rule without endpoints allows all the protected endpoints. The granted
+	// endpoints narrow the protected endpoints, they never extend them
+	if allEndpoints {
+		granted.Endpoints = nil
+	}
+	if allMethods {
+		granted.Methods = nil
+	}
+	return granted
+}
+
+func (auth *PolicyAuth) getPolicy() *pkg.Policy {
+	auth.policyLock.RLock()
+	defer auth.policyLock.RUnlock()
+	return auth.policy
+}
+
+func ruleMatches(rule *pkg.Rule, identity *Identity) bool {
+	for _, user := range rule.Users {
+		if user != "" && user == identity.Name {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		for _, g := range identity.Groups {
+			if group == g {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+)
+
+type testIdentityAuth struct {
+	testAuth
+	identity *Identity
+}
+
+func (a *testIdentityAuth) IsAuthorized(r *http.Request) (*Identity, error) {
+	if a.identity == nil {
+		return nil, errMissingCredentials
+	}
+	return a.identity, nil
+}
+
+func TestPolicy_IsAuthorized(t *testing.T) {
+	policy := &pkg.Policy{
+		Rules: []pkg.Rule{
+			{
+				Groups:     []string{"team-a"},
+				Namespaces: []string{"tenant-a"},
+			}, {
+				Users:      []string{"alice"},
+				Groups:     []string{"sre"},
+				Namespaces: []string{"monitoring"},
+				Labels:     map[string][]string{"team": {"sre"}},
+				Endpoints:  []string{"/api/v1/query"},
+			},
+		},
+	}
+
+	testCases := []struct {
+		desc       string
+		identity   *Identity
+		authorized bool
+		expected   *Identity
+	}{
+		{"unauthenticated", nil, false, nil},
+		{
+			"no matching rule",
+			&Identity{Name: "bob", Groups: []string{"team-b"}, Namespaces: []string{"tenant-b"}},
+			true,
+			&Identity{Name: "bob", Groups: []string{"team-b"}, Namespaces: []string{}, Labels: map[string][]string{}},
+		}, {
+			"user rule",
+			&Identity{Name: "alice"},
+			true,
+			&Identity{Name: "alice", Namespaces: []string{"monitoring"}, Labels: map[string][]string{"team": {"sre"}}, Endpoints: []string{"/api/v1/query"}},
+		}, {
+			"group rule",
+			&Identity{Name: "bob", Groups: []string{"team-a"}},
+			true,
+			&Identity{Name: "bob", Groups: []string{"team-a"}, Namespaces: []string{"tenant-a"}, Labels: map[string][]string{}},
+		}, {
+			"union of rules",
+			&Identity{Name: "carol", Groups: []string{"team-a", "sre"}},
+			true,
+			&Identity{Name: "carol", Groups: []string{"team-a", "sre"}, Namespaces: []string{"tenant-a", "monitoring"}, Labels: map[string][]string{"team": {"sre"}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			auth := newPolicyAuthFromPolicy(&testIdentityAuth{identity: tc.identity}, policy)
+			identity, err := auth.IsAuthorized(httptest.NewRequest("GET", "http://example.com", nil))
+			authorized := err == nil
+			if authorized != tc.authorized {
+				t.Fatalf("authorized=%v, expected=%v", authorized, tc.authorized)
+			}
+			if !reflect.DeepEqual(identity, tc.expected) {
+				t.Errorf("Got unexpected identity: %+v", identity)
+			}
+		})
+	}
+}
+
+func TestPolicy_RateLimit(t *testing.T) {
+	slow := &pkg.RateLimit{Rate: 1}
+	fast := &pkg.RateLimit{Rate: 10}
+	policy := &pkg.Policy{
+		Rules: []pkg.Rule{
+			{Groups: []string{"batch"}, Namespaces: []string{"tenant-a"}, RateLimit: slow},
+			{Groups: []string{"dashboards"}, Namespaces: []string{"tenant-a"}, RateLimit: fast},
+			{Groups: []string{"unlimited"}, Namespaces: []string{"tenant-a"}},
+		},
+	}
+
+	testCases := []struct {
+		groups   []string
+		expected *pkg.RateLimit
+	}{
+		{[]string{"batch"}, slow},
+		{[]string{"batch", "dashboards"}, fast},
+		{[]string{"unlimited"}, nil},
+	}
+
+	for _, tc := range testCases {
+		identity := &Identity{Name: "alice", Groups: tc.groups, RateLimit: &pkg.RateLimit{Rate: 100}}
+		auth := newPolicyAuthFromPolicy(&testIdentityAuth{identity: identity}, policy)
+		granted, _ := auth.IsAuthorized(httptest.NewRequest("GET", "http://example.com", nil))
+		if granted.RateLimit != tc.expected {
+			t.Errorf("groups %v: got rate limit %+v, expected %+v", tc.groups, granted.RateLimit, tc.expected)
+		}
+	}
+}
+
+func TestPolicy_Endpoints(t *testing.T) {
+	whitelist := NewRouteMatcher("", []string{"/api/v1/query", "/api/v1/query_range"})
+	testCases := []struct {
+		desc   string
+		rules  []pkg.Rule
+		path   string
+		status int
+	}{
+		{"granted endpoint", []pkg.Rule{{Users: []string{"alice"}, Namespaces: []string{"ns"}, Endpoints: []string{"/api/v1/query"}}}, "/api/v1/query", http.StatusOK},
+		{"other protected endpoint", []pkg.Rule{{Users: []string{"alice"}, Namespaces: []string{"ns"}, Endpoints: []string{"/api/v1/query"}}}, "/api/v1/query_range", http.StatusForbidden},
+		{"unprotected endpoint", []pkg.Rule{{Users: []string{"alice"}, Namespaces: []string{"ns"}, Endpoints: []string{"/api/v1/read"}}}, "/api/v1/read", http.StatusForbidden},
+		{"all endpoints", []pkg.Rule{{Users: []string{"alice"}, Namespaces: []string{"ns"}, Endpoints: []string{"*"}}}, "/federate", http.StatusForbidden},
+		{
+			"rule without endpoints",
+			[]pkg.Rule{
+				{Users: []string{"alice"}, Namespaces: []string{"ns"}},
+				{Users: []string{"alice"}, Namespaces: []string{"ns"}, Endpoints: []string{"/api/v1/read"}},
+			},
+			"/api/v1/read",
+			http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			auth := newPolicyAuthFromPolicy(&testIdentityAuth{identity: &Identity{Name: "alice"}}, &pkg.Policy{Rules: tc.rules})
+			w := httptest.NewRecorder()
+			AuthHandler(auth, whitelist, func(w http.ResponseWriter, r *http.Request) {})(w, httptest.NewRequest("GET", tc.path, nil))
+			if w.Code != tc.status {
+				t.Errorf("Got status %d, expected %d", w.Code, tc.status)
+			}
+		})
+	}
+}
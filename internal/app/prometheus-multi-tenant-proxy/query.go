@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// QueryError describes why a request is rejected instead of being forwarded to Prometheus
+type QueryError struct {
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return e.Reason
+}
+
+// rejectRequest marks the request to be rejected by the RoundTripper instead of being forwarded
+func rejectRequest(req *http.Request, err error) {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		rejectedQueries.WithLabelValues("limit").Inc()
+	} else {
+		rejectedQueries.WithLabelValues("invalid").Inc()
+		queryErr = &QueryError{Reason: err.Error()}
+	}
+	if record := auditRecord(req.Context()); record != nil {
+		record.Rejection = queryErr.Reason
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), rejectionKey, queryErr))
+}
+
+// checkExpr returns an error if the expression exceeds the query limits
+func checkExpr(expr parser.Expr, limits *pkg.QueryLimits) error {
+	if limits == nil {
+		return nil
+	}
+	denied, err := deniedMetricsMatcher(limits)
+	if err != nil {
+		return err
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			name := metricName(n)
+			if limits.RequireMetricName && name == "" {
+				err = &QueryError{Reason: fmt.Sprintf("selector %s has no metric name", n)}
+			} else if denied != nil && name != "" && denied.Matches(name) && !limits.StripDeniedMetrics {
+				err = &QueryError{Reason: fmt.Sprintf("metric %s is denied", name)}
+			}
+		case *parser.Call:
+			if slices.Contains(limits.DeniedFunctions, n.Func.Name) {
+				err = &QueryError{Reason: fmt.Sprintf("function %s is denied", n.Func.Name)}
+			}
+		case *parser.AggregateExpr:
+			if op := n.Op.String(); slices.Contains(limits.DeniedFunctions, op) {
+				err = &QueryError{Reason: fmt.Sprintf("aggregation %s is denied", op)}
+			}
+		case *parser.MatrixSelector:
+			err = checkRange(n.Range, limits, n)
+		case *parser.SubqueryExpr:
+			err = checkRange(n.Range, limits, n)
+		}
+		return err
+	})
+	return err
+}
+
+// limitLookback restricts the evaluation time range of the expression so that it does not select samples
+// older than the lookback limit through its offsets, range selectors or subqueries: the start, or the time
+// of instant queries, is delayed if the time range is clamped, otherwise the query is rejected. Selectors
+// whose @ modifier fixes their evaluation time too far in the past are always rejected.
+func limitLookback(expr parser.Expr, form url.Values, instant bool, now time.Time, limits *pkg.QueryLimits) error {
+	if limits == nil || limits.MaxLookback == 0 {
+		return nil
+	}
+	startParam := "start"
+	if instant {
+		startParam = "time"
+	}
+	start, end := now, now
+	if form.Has(startParam) {
+		t, err := parseTime(form.Get(startParam))
+		if err != nil {
+			// Let Prometheus report invalid parameters
+			return nil
+		}
+		start = t
+	}
+	if instant {
+		end = start
+	} else if form.Has("end") {
+		t, err := parseTime(form.Get("end"))
+		if err != nil {
+			return nil
+		}
+		end = t
+	}
+	// The time parameters have a millisecond precision
+	oldest := now.Add(-time.Duration(limits.MaxLookback)).Truncate(time.Millisecond)
+
+	// reach is how far before the evaluation time the expression selects samples
+	var reach time.Duration
+	var err error
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		// fixed is the evaluation time set by an @ modifier, that clamping the start does not move
+		var fixed *time.Time
+		var selected time.Duration
+		for _, ancestor := range path {
+			if subquery, ok := ancestor.(*parser.SubqueryExpr); ok {
+				fixed, selected = atModifier(subquery.Timestamp, subquery.StartOrEnd, end, fixed, selected)
+				selected += subquery.OriginalOffset + subquery.Range
+			}
+		}
+		fixed, selected = atModifier(selector.Timestamp, selector.StartOrEnd, end, fixed, selected)
+		selected += selector.OriginalOffset
+		if len(path) > 0 {
+			if matrix, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+				selected += matrix.Range
+			}
+		}
+		if fixed == nil {
+			reach = max(reach, selected)
+		} else if fixed.Add(-selected).Before(oldest) {
+			err = &QueryError{Reason: fmt.Sprintf("selector %s reaches data older than the lookback limit of %s", selector, limits.MaxLookback)}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	earliest := oldest.Add(reach)
+	if !start.Before(earliest) {
+		return nil
+	}
+	// The start cannot be delayed past the end of range queries, nor the time of instant queries past now
+	latest := end
+	if instant {
+		latest = now
+	}
+	if !limits.ClampTimeRange || earliest.After(latest) {
+		return &QueryError{Reason: fmt.Sprintf("query reaches data older than the lookback limit of %s", limits.MaxLookback)}
+	}
+	form.Set(startParam, formatTime(earliest))
+	return nil
+}
+
+// atModifier returns the evaluation time set by an @ modifier and resets the selected duration,
+// @ start() evaluates at the earliest evaluation time and is not fixed.
+// The fixed time and selected duration are returned unchanged without @ modifier.
+func atModifier(timestamp *int64, startOrEnd parser.ItemType, end time.Time, fixed *time.Time, selected time.Duration) (*time.Time, time.Duration) {
+	switch {
+	case timestamp != nil:
+		t := time.UnixMilli(*timestamp)
+		return &t, 0
+	case startOrEnd == parser.START:
+		return nil, 0
+	case startOrEnd == parser.END:
+		return &end, 0
+	}
+	return fixed, selected
+}
+
+func checkRange(r time.Duration, limits *pkg.QueryLimits, node parser.Node) error {
+	if limits.MaxRangeSelector > 0 && r > time.Duration(limits.MaxRangeSelector) {
+		return &QueryError{Reason: fmt.Sprintf("range of %s exceeds the limit of %s", node, limits.MaxRangeSelector)}
+	}
+	return nil
+}
+
+// metricName returns the metric name selected by the selector, empty if it selects several metrics
+func metricName(selector *parser.VectorSelector) string {
+	if selector.Name != "" {
+		return selector.Name
+	}
+	for _, m := range selector.LabelMatchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// enforceDeniedMetrics hides the denied metrics from the selectors of the expression. A negative matcher
+// is added to the selectors without metric name, e.g. {__name__=~".+"}, as the metric name cannot be set twice.
+// The selectors naming a denied metric, only left by checkExpr when they are stripped, match no series anymore.
+func enforceDeniedMetrics(expr parser.Expr, limits *pkg.QueryLimits) error {
+	denied, err := deniedMetricsMatcher(limits)
+	if err != nil || denied == nil {
+		return err
+	}
+	notDenied, err := labels.NewMatcher(labels.MatchNotRegexp, denied.Name, denied.Value)
+	if err != nil {
+		return err
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		name := metricName(selector)
+		if name != "" && !denied.Matches(name) {
+			return nil
+		}
+		// The parser keeps the metric name among the matchers, so the selector of a denied
+		// metric becomes {__name__="<metric>",__name__!~"<denied>"}
+		selector.Name = ""
+		selector.LabelMatchers = append(selector.LabelMatchers, notDenied)
+		return nil
+	})
+	return nil
+}
+
+// deniedMetricsMatcher returns a matcher of the denied metric names, nil if no metric is denied
+func deniedMetricsMatcher(limits *pkg.QueryLimits) (*labels.Matcher, error) {
+	if limits == nil || len(limits.DeniedMetrics) == 0 {
+		return nil, nil
+	}
+	m := regexpMatcher(labels.MetricName, limits.DeniedMetrics, false)
+	return labels.NewMatcher(m.Type, m.Name, m.Value)
+}
+
+// checkQueryRange returns an error if the step of a range query exceeds the query limits
+func checkQueryRange(form url.Values, limits *pkg.QueryLimits) error {
+	if limits == nil || !form.Has("step") {
+		return nil
+	}
+	step, err := parseDuration(form.Get("step"))
+	if err != nil || step <= 0 {
+		// Let Prometheus report invalid parameters
+		return nil
+	}
+	if limits.MinStep > 0 && step < time.Duration(limits.MinStep) {
+		return &QueryError{Reason: fmt.Sprintf("step %s is below the limit of %s", step, limits.MinStep)}
+	}
+	start, errStart := parseTime(form.Get("start"))
+	end, errEnd := parseTime(form.Get("end"))
+	if limits.MaxPoints > 0 && errStart == nil && errEnd == nil {
+		if points := int64(end.Sub(start)/step) + 1; points > int64(limits.MaxPoints) {
+			return &QueryError{Reason: fmt.Sprintf("%d points per series exceed the limit of %d, increase the step or reduce the range", points, limits.MaxPoints)}
+		}
+	}
+	return nil
+}
+
+// limitTimeRange restricts the time parameters of the request to the lookback window and the maximum
+// time range of the query limits, clamping them or returning an error depending on the limits.
+// Instant queries use the time parameter, other requests the start and end parameters.
+func limitTimeRange(form url.Values, instant bool, now time.Time, limits *pkg.QueryLimits) error {
+	if limits == nil || (limits.MaxLookback == 0 && limits.MaxTimeRange == 0) {
+		return nil
+	}
+	var oldest time.Time
+	if limits.MaxLookback > 0 {
+		oldest = now.Add(-time.Duration(limits.MaxLookback))
+	}
+
+	if instant {
+		if !form.Has("time") || oldest.IsZero() {
+			return nil
+		}
+		t, err := parseTime(form.Get("time"))
+		if err != nil || !t.Before(oldest) {
+			return nil
+		}
+		if !limits.ClampTimeRange {
+			return &QueryError{Reason: fmt.Sprintf("time is older than the lookback limit of %s", limits.MaxLookback)}
+		}
+		form.Set("time", formatTime(oldest))
+		return nil
+	}
+
+	end := now
+	if form.Has("end") {
+		t, err := parseTime(form.Get("end"))
+		if err != nil {
+			return nil
+		}
+		end = t
+	}
+	if !oldest.IsZero() && end.Before(oldest) {
+		// Clamping the start would make it later than the end
+		return &QueryError{Reason: fmt.Sprintf("time range is older than the lookback limit of %s", limits.MaxLookback)}
+	}
+	if limits.MaxTimeRange > 0 {
+		if earliest := end.Add(-time.Duration(limits.MaxTimeRange)); earliest.After(oldest) {
+			oldest = earliest
+		}
+	}
+	if !form.Has("start") {
+		// No start means all the history
+		form.Set("start", formatTime(oldest))
+		return nil
+	}
+	start, err := parseTime(form.Get("start"))
+	if err != nil || !start.Before(oldest) {
+		return nil
+	}
+	if !limits.ClampTimeRange {
+		return &QueryError{Reason: fmt.Sprintf("time range exceeds the limits: lookback of %s, range of %s",
+			limits.MaxLookback, limits.MaxTimeRange)}
+	}
+	form.Set("start", formatTime(oldest))
+	return nil
+}
+
+// formatTime formats a time parameter of the Prometheus API
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
+
+// parseTime parses a time parameter of the Prometheus API: a unix timestamp or a RFC3339 date
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		seconds, fraction := math.Modf(t)
+		return time.Unix(int64(seconds), int64(math.Round(fraction*1e9))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses a duration parameter of the Prometheus API: a number of seconds or a duration
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestQuery_checkExpr(t *testing.T) {
+	limits := &pkg.QueryLimits{
+		MaxRangeSelector:  model.Duration(time.Hour),
+		RequireMetricName: true,
+	}
+
+	testCases := []struct {
+		query string
+		ok    bool
+	}{
+		{`up`, true},
+		{`up{namespace="a"}`, true},
+		{`{__name__="up",namespace="a"}`, true},
+		{`{namespace="a"}`, false},
+		{`{__name__=~"up|down"}`, false},
+		{`sum(rate(http_requests_total[5m])) / sum(rate({job="a"}[5m]))`, false},
+		{`rate(http_requests_total[1h])`, true},
+		{`rate(http_requests_total[2h])`, false},
+		{`max_over_time(rate(http_requests_total[5m])[1h:1m])`, true},
+		{`max_over_time(rate(http_requests_total[5m])[1d:1m])`, false},
+		{`vector(1)`, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkExpr(expr, limits); (err == nil) != tc.ok {
+				t.Errorf("checkExpr() = %v, expected ok=%v", err, tc.ok)
+			}
+		})
+	}
+
+	denied := &pkg.QueryLimits{
+		DeniedMetrics:   []string{"etcd_db_total_size_in_bytes", "~apiserver_.*"},
+		DeniedFunctions: []string{"count_values", "absent"},
+	}
+	deniedCases := []struct {
+		query string
+		ok    bool
+	}{
+		{`up`, true},
+		{`etcd_db_total_size_in_bytes`, false},
+		{`sum(rate(apiserver_request_total[5m]))`, false},
+		{`{__name__="apiserver_request_total"}`, false},
+		{`{__name__=~"apiserver_.*"}`, true},
+		{`etcd_db_total_size_in_bytes_other`, true},
+		{`count_values("value", up)`, false},
+		{`absent(up)`, false},
+		{`count(up)`, true},
+	}
+	for _, tc := range deniedCases {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkExpr(expr, denied); (err == nil) != tc.ok {
+				t.Errorf("checkExpr() = %v, expected ok=%v", err, tc.ok)
+			}
+		})
+	}
+
+	strip := &pkg.QueryLimits{DeniedMetrics: []string{"~apiserver_.*"}, StripDeniedMetrics: true}
+	expr, _ := parser.ParseExpr(`apiserver_request_total`)
+	if err := checkExpr(expr, strip); err != nil {
+		t.Errorf("Denied metrics should not be rejected when stripped: %v", err)
+	}
+
+	expr, _ = parser.ParseExpr(`{namespace="a"}[1y]`)
+	if err := checkExpr(expr, nil); err != nil {
+		t.Errorf("Queries should not be limited without limits: %v", err)
+	}
+}
+
+func TestQuery_checkQueryRange(t *testing.T) {
+	limits := &pkg.QueryLimits{
+		MinStep:   model.Duration(15 * time.Second),
+		MaxPoints: 1000,
+	}
+
+	testCases := []struct {
+		desc  string
+		query string
+		ok    bool
+	}{
+		{"instant query", "query=up&time=1700000000", true},
+		{"valid step", "query=up&start=1700000000&end=1700003600&step=15", true},
+		{"duration step", "query=up&start=1700000000&end=1700003600&step=1m", true},
+		{"tiny step", "query=up&start=1700000000&end=1700000060&step=1", false},
+		{"tiny duration step", "query=up&start=1700000000&end=1700000060&step=5s", false},
+		{"too many points", "query=up&start=1700000000&end=1700086400&step=60", false},
+		{"rfc3339 dates", "query=up&start=2023-11-14T22:13:20Z&end=2023-11-15T22:13:20Z&step=60", false},
+		{"max points", "query=up&start=1700000000&end=1700014985&step=15", true},
+		{"invalid step", "query=up&start=1700000000&end=1700086400&step=foo", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			form, _ := url.ParseQuery(tc.query)
+			if err := checkQueryRange(form, limits); (err == nil) != tc.ok {
+				t.Errorf("checkQueryRange() = %v, expected ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestQuery_parseTime(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Time
+		ok       bool
+	}{
+		{"1700000000", time.Unix(1700000000, 0), true},
+		{"1700000000.5", time.Unix(1700000000, 5e8), true},
+		{"2023-11-14T22:13:20Z", time.Unix(1700000000, 0), true},
+		{"2023-11-14T22:13:20.5+01:00", time.Unix(1699996400, 5e8), true},
+		{"yesterday", time.Time{}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			parsed, err := parseTime(tc.value)
+			if (err == nil) != tc.ok {
+				t.Fatalf("parseTime() error = %v, expected ok=%v", err, tc.ok)
+			}
+			if !parsed.Equal(tc.expected) {
+				t.Errorf("parseTime() = %v, expected %v", parsed, tc.expected)
+			}
+		})
+	}
+}
+
+func TestQuery_parseDuration(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"15", 15 * time.Second, true},
+		{"0.5", 500 * time.Millisecond, true},
+		{"1m", time.Minute, true},
+		{"1d", 24 * time.Hour, true},
+		{"soon", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			parsed, err := parseDuration(tc.value)
+			if (err == nil) != tc.ok {
+				t.Fatalf("parseDuration() error = %v, expected ok=%v", err, tc.ok)
+			}
+			if parsed != tc.expected {
+				t.Errorf("parseDuration() = %v, expected %v", parsed, tc.expected)
+			}
+		})
+	}
+}
+
+func TestQuery_limitTimeRange(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	week := model.Duration(7 * 24 * time.Hour)
+	day := model.Duration(24 * time.Hour)
+	reject := &pkg.QueryLimits{MaxLookback: week, MaxTimeRange: day}
+	clamp := &pkg.QueryLimits{MaxLookback: week, MaxTimeRange: day, ClampTimeRange: true}
+	lookbackOnly := &pkg.QueryLimits{MaxLookback: week, ClampTimeRange: true}
+
+	testCases := []struct {
+		desc     string
+		limits   *pkg.QueryLimits
+		instant  bool
+		query    string
+		ok       bool
+		expected string
+	}{
+		{"no limits", nil, false, "start=0&end=1700000000", true, "end=1700000000&start=0"},
+		{"instant now", reject, true, "query=up", true, "query=up"},
+		{"instant recent", reject, true, "query=up&time=1699999000", true, "query=up&time=1699999000"},
+		{"instant old", reject, true, "query=up&time=1690000000", false, ""},
+		{"instant old clamped", clamp, true, "query=up&time=1690000000", true, "query=up&time=1699395200"},
+		{"range within limits", reject, false, "start=1699990000&end=1700000000", true, "end=1700000000&start=1699990000"},
+		{"range too long", reject, false, "start=1699800000&end=1700000000", false, ""},
+		{"range too long clamped", clamp, false, "start=1699800000&end=1700000000", true, "end=1700000000&start=1699913600"},
+		{"range too old", reject, false, "start=1690000000&end=1690003600", false, ""},
+		{"range too old clamped", lookbackOnly, false, "start=1690000000&end=1699999000", true, "end=1699999000&start=1699395200"},
+		{"range ending too old clamped", lookbackOnly, false, "start=1690000000&end=1690003600", false, ""},
+		{"missing start", reject, false, "match[]=up", true, "match[]=up&start=1699913600"},
+		{"missing start and end", lookbackOnly, false, "", true, "start=1699395200"},
+		{"rfc3339 start", reject, false, "start=2023-11-14T00:00:00Z&end=2023-11-14T22:13:20Z", true, "end=2023-11-14T22:13:20Z&start=2023-11-14T00:00:00Z"},
+		{"invalid start", reject, false, "start=foo&end=1700000000", true, "end=1700000000&start=foo"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			form, _ := url.ParseQuery(tc.query)
+			err := limitTimeRange(form, tc.instant, now, tc.limits)
+			if (err == nil) != tc.ok {
+				t.Fatalf("limitTimeRange() = %v, expected ok=%v", err, tc.ok)
+			}
+			if err != nil {
+				return
+			}
+			if parsed, _ := url.QueryUnescape(form.Encode()); parsed != tc.expected {
+				t.Errorf("Got parameters %s, expected %s", parsed, tc.expected)
+			}
+		})
+	}
+}
+
+func TestQuery_limitLookback(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	week := model.Duration(7 * 24 * time.Hour)
+	reject := &pkg.QueryLimits{MaxLookback: week}
+	clamp := &pkg.QueryLimits{MaxLookback: week, ClampTimeRange: true}
+
+	testCases := []struct {
+		desc     string
+		limits   *pkg.QueryLimits
+		instant  bool
+		query    string
+		ok       bool
+		expected string
+	}{
+		{"no limits", nil, true, "query=up offset 30d&time=1700000000", true, "query=up offset 30d&time=1700000000"},
+		{"selector", reject, true, "query=up&time=1699395200", true, "query=up&time=1699395200"},
+		{"offset within limit", reject, true, "query=up offset 1d&time=1700000000", true, "query=up offset 1d&time=1700000000"},
+		{"offset too old", reject, true, "query=up offset 30d&time=1700000000", false, ""},
+		{"offset too old clamped", clamp, true, "query=up offset 1d&time=1699395200", true, "query=up offset 1d&time=1699481600"},
+		{"offset past lookback clamped", clamp, true, "query=up offset 30d&time=1700000000", false, ""},
+		{"range past lookback clamped", clamp, true, "query=max_over_time(up[8d])&time=1699395200", false, ""},
+		{"range selector too old", reject, true, "query=max_over_time(up[30d])&time=1700000000", false, ""},
+		{"range selector and offset too old", reject, true, "query=max_over_time(up[4d] offset 4d)&time=1700000000", false, ""},
+		{"range selector clamped", clamp, false, "query=rate(up[5m])&start=1699395200&end=1700000000", true, "end=1700000000&query=rate(up[5m])&start=1699395500"},
+		{"subquery too old", reject, true, "query=max_over_time(rate(up[5m])[30d:1m])&time=1700000000", false, ""},
+		{"subquery offset too old", reject, true, "query=max_over_time(rate(up[5m])[1d:1m] offset 7d)&time=1700000000", false, ""},
+		{"at timestamp within limit", reject, true, "query=up @ 1699999000&time=1700000000", true, "query=up @ 1699999000&time=1700000000"},
+		{"at timestamp too old", clamp, true, "query=up @ 1600000000&time=1700000000", false, ""},
+		{"at timestamp in long subquery", reject, true, "query=max_over_time((up @ 1699999000)[30d:1m])&time=1700000000", true, "query=max_over_time((up @ 1699999000)[30d:1m])&time=1700000000"},
+		{"at timestamp in old subquery", reject, true, "query=max_over_time(up[5m] @ 1699999000)&time=1600000000", false, ""},
+		{"at start", reject, false, "query=up @ start()&start=1699990000&end=1700000000", true, "end=1700000000&query=up @ start()&start=1699990000"},
+		{"at end too old", clamp, false, "query=max_over_time(up[30d] @ end())&start=1699990000&end=1700000000", false, ""},
+		{"clamped past end", clamp, false, "query=up offset 7d&start=1699990000&end=1699999000", false, ""},
+		{"missing time", reject, true, "query=up offset 1d", true, "query=up offset 1d"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			form, _ := url.ParseQuery(tc.query)
+			expr, err := parser.ParseExpr(form.Get("query"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = limitLookback(expr, form, tc.instant, now, tc.limits)
+			if (err == nil) != tc.ok {
+				t.Fatalf("limitLookback() = %v, expected ok=%v", err, tc.ok)
+			}
+			if err != nil {
+				return
+			}
+			if parsed, _ := url.QueryUnescape(form.Encode()); parsed != tc.expected {
+				t.Errorf("Got parameters %s, expected %s", parsed, tc.expected)
+			}
+		})
+	}
+}
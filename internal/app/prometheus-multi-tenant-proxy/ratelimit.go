@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitSweepInterval is how often the idle buckets are removed
+const rateLimitSweepInterval = time.Minute
+
+// RateLimiter limits the requests of every user with a token bucket
+type RateLimiter struct {
+	// defaultLimit applies to the users without rate limit, unlimited if nil
+	defaultLimit *pkg.RateLimit
+	buckets      map[string]*rateLimitBucket
+	lastSweep    time.Time
+	lock         *sync.Mutex
+	now          func() time.Time
+}
+
+type rateLimitBucket struct {
+	limiter  *rate.Limiter
+	limit    pkg.RateLimit
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a RateLimiter applying defaultLimit to the users without rate limit
+func NewRateLimiter(defaultLimit *pkg.RateLimit) *RateLimiter {
+	return &RateLimiter{
+		defaultLimit: defaultLimit,
+		buckets:      make(map[string]*rateLimitBucket),
+		lock:         new(sync.Mutex),
+		now:          time.Now,
+	}
+}
+
+// RateLimitHandler returns a middleware handler rejecting the requests of the users
+// exceeding their rate limit with a 429 Too Many Requests response.
+// The rate limited users without name are rejected with a 403 Forbidden response, as they cannot be told apart.
+// It must be called after AuthHandler, which sets the identity of the user and its backend.
+func RateLimitHandler(limiter *RateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := r.Context().Value(IdentityKey).(*Identity)
+		if !ok {
+			handler(w, r)
+			return
+		}
+		if identity.Name == "" && limiter.limit(identity) != nil {
+			requestLogger(r.Context()).Warn("Rate limited user without name")
+			writeErrorResponse(w, http.StatusForbidden, "rate limited user without name")
+			return
+		}
+		backend, _ := r.Context().Value(backendKey).(string)
+		if delay := limiter.Reserve(backend, identity, r.URL.Path); delay > 0 {
+			requestLogger(r.Context()).Warn("Rate limit exceeded", "retry_after", delay)
+			rateLimitedRequests.WithLabelValues(identity.Name).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeErrorResponse(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Reserve takes a token from the bucket of the user authenticated by the given backend for
+// the given endpoint. It returns zero if the request is allowed, or how long to wait before
+// retrying otherwise. Users with the same name in different backends have their own bucket.
+func (l *RateLimiter) Reserve(backend string, identity *Identity, endpoint string) time.Duration {
+	limit := l.limit(identity)
+	if limit == nil {
+		return 0
+	}
+	key := backend + "\x00" + identity.Name
+	if limit.PerEndpoint {
+		key += "\x00" + endpoint
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.sweep(now)
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &rateLimitBucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.GetBurst())}
+		l.buckets[key] = bucket
+	}
+	if bucket.limit != *limit {
+		// The configuration was reloaded
+		bucket.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+		bucket.limiter.SetBurstAt(now, limit.GetBurst())
+	}
+	bucket.limit = *limit
+	bucket.lastSeen = now
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// limit returns the rate limit of the user, nil if unlimited
+func (l *RateLimiter) limit(identity *Identity) *pkg.RateLimit {
+	if identity.RateLimit != nil {
+		return identity.RateLimit
+	}
+	return l.defaultLimit
+}
+
+// sweep removes the buckets that are full again, as they behave like new ones
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		refill := time.Duration(float64(bucket.limit.GetBurst()) / bucket.limit.Rate * float64(time.Second))
+		if now.Sub(bucket.lastSeen) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestRateLimiter(defaultLimit *pkg.RateLimit) (*RateLimiter, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(defaultLimit)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestRateLimit_Reserve(t *testing.T) {
+	limiter, now := newTestRateLimiter(nil)
+	identity := &Identity{Name: "alice", RateLimit: &pkg.RateLimit{Rate: 1, Burst: 2}}
+
+	for i := 0; i < 2; i++ {
+		if delay := limiter.Reserve("basic", identity, "/api/v1/query"); delay != 0 {
+			t.Fatalf("Request %d should be allowed by the burst, got delay %v", i, delay)
+		}
+	}
+	if delay := limiter.Reserve("basic", identity, "/api/v1/query"); delay != time.Second {
+		t.Errorf("Request should be delayed by 1s, got %v", delay)
+	}
+	// Rejected requests do not consume tokens
+	*now = now.Add(time.Second)
+	if delay := limiter.Reserve("basic", identity, "/api/v1/query"); delay != 0 {
+		t.Errorf("Request should be allowed after refill, got delay %v", delay)
+	}
+	// Other users have their own bucket
+	if delay := limiter.Reserve("basic", &Identity{Name: "bob", RateLimit: identity.RateLimit}, "/api/v1/query"); delay != 0 {
+		t.Errorf("Other users should not be limited, got delay %v", delay)
+	}
+	// Users with the same name in other backends have their own bucket
+	if delay := limiter.Reserve("jwt", &Identity{Name: "alice", RateLimit: identity.RateLimit}, "/api/v1/query"); delay != 0 {
+		t.Errorf("Users of other backends should not be limited, got delay %v", delay)
+	}
+}
+
+func TestRateLimit_PerEndpoint(t *testing.T) {
+	limiter, _ := newTestRateLimiter(nil)
+
+	testCases := []struct {
+		perEndpoint bool
+		allowed     bool
+	}{
+		{false, false},
+		{true, true},
+	}
+
+	for _, tc := range testCases {
+		identity := &Identity{Name: "alice", RateLimit: &pkg.RateLimit{Rate: 1, PerEndpoint: tc.perEndpoint}}
+		limiter.buckets = map[string]*rateLimitBucket{}
+		limiter.Reserve("basic", identity, "/api/v1/query")
+		if delay := limiter.Reserve("basic", identity, "/api/v1/series"); (delay == 0) != tc.allowed {
+			t.Errorf("perEndpoint=%v: request to another endpoint got delay %v", tc.perEndpoint, delay)
+		}
+	}
+}
+
+func TestRateLimit_Default(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		defaultLimit *pkg.RateLimit
+		limit        *pkg.RateLimit
+		allowed      int
+	}{
+		{"unlimited", nil, nil, 100},
+		{"default", &pkg.RateLimit{Rate: 1, Burst: 3}, nil, 3},
+		{"user limit overrides default", &pkg.RateLimit{Rate: 1, Burst: 3}, &pkg.RateLimit{Rate: 10}, 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			limiter, _ := newTestRateLimiter(tc.defaultLimit)
+			identity := &Identity{Name: "alice", RateLimit: tc.limit}
+			allowed := 0
+			for i := 0; i < 100; i++ {
+				if limiter.Reserve("basic", identity, "/api/v1/query") == 0 {
+					allowed++
+				}
+			}
+			if allowed != tc.allowed {
+				t.Errorf("%d requests allowed, expected %d", allowed, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestRateLimit_Reload(t *testing.T) {
+	limiter, now := newTestRateLimiter(nil)
+	identity := &Identity{Name: "alice", RateLimit: &pkg.RateLimit{Rate: 1}}
+
+	limiter.Reserve("basic", identity, "/api/v1/query")
+	if delay := limiter.Reserve("basic", identity, "/api/v1/query"); delay == 0 {
+		t.Fatal("Request should be limited")
+	}
+	identity.RateLimit = &pkg.RateLimit{Rate: 10}
+	*now = now.Add(100 * time.Millisecond)
+	// 0.1 token refilled at the old rate, the 0.9 remaining at the new one
+	if delay := limiter.Reserve("basic", identity, "/api/v1/query"); delay != 90*time.Millisecond {
+		t.Errorf("Request should be delayed by 90ms with the new rate, got delay %v", delay)
+	}
+}
+
+func TestRateLimit_Sweep(t *testing.T) {
+	limiter, now := newTestRateLimiter(nil)
+	limiter.Reserve("basic", &Identity{Name: "alice", RateLimit: &pkg.RateLimit{Rate: 1}}, "/api/v1/query")
+	limiter.Reserve("basic", &Identity{Name: "bob", RateLimit: &pkg.RateLimit{Rate: 0.001}}, "/api/v1/query")
+
+	*now = now.Add(2 * rateLimitSweepInterval)
+	limiter.Reserve("basic", &Identity{Name: "carol", RateLimit: &pkg.RateLimit{Rate: 1}}, "/api/v1/query")
+	if _, found := limiter.buckets["basic\x00alice"]; found {
+		t.Errorf("Full buckets should be removed")
+	}
+	if _, found := limiter.buckets["basic\x00bob"]; !found {
+		t.Errorf("Buckets still refilling should be kept")
+	}
+}
+
+func TestRateLimit_Handler(t *testing.T) {
+	limiter, _ := newTestRateLimiter(nil)
+	identity := &Identity{Name: "handler-test", RateLimit: &pkg.RateLimit{Rate: 0.1}}
+	handlerCalled := 0
+	h := RateLimitHandler(limiter, func(w http.ResponseWriter, r *http.Request) {
+		handlerCalled++
+	})
+
+	testCases := []struct {
+		status     int
+		retryAfter string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusTooManyRequests, "10"},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "http://example.com/api/v1/query", nil)
+		r = r.WithContext(context.WithValue(r.Context(), IdentityKey, identity))
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tc.status {
+			t.Errorf("Wrong status code: %d, expected %d", w.Code, tc.status)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != tc.retryAfter {
+			t.Errorf("Wrong Retry-After: %q, expected %q", retryAfter, tc.retryAfter)
+		}
+	}
+	if handlerCalled != 1 {
+		t.Errorf("Handler called %d times, expected once", handlerCalled)
+	}
+	if rejected := testutil.ToFloat64(rateLimitedRequests.WithLabelValues("handler-test")); rejected != 1 {
+		t.Errorf("Rejected requests counter is %v, expected 1", rejected)
+	}
+}
+
+func TestRateLimit_HandlerWithoutName(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		defaultLimit *pkg.RateLimit
+		status       int
+	}{
+		{"unlimited", nil, http.StatusOK},
+		{"limited", &pkg.RateLimit{Rate: 100}, http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			limiter, _ := newTestRateLimiter(tc.defaultLimit)
+			h := RateLimitHandler(limiter, func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest("GET", "http://example.com/api/v1/query", nil)
+			r = r.WithContext(context.WithValue(r.Context(), IdentityKey, &Identity{}))
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tc.status {
+				t.Errorf("Wrong status code: %d, expected %d", w.Code, tc.status)
+			}
+			if len(limiter.buckets) != 0 {
+				t.Errorf("Users without name should not get a bucket")
+			}
+		})
+	}
+}
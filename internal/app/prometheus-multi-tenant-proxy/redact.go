@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the secrets in the logs
+const redacted = "[REDACTED]"
+
+// DefaultRedactedParams are the query parameters redacted from the logs by default
+var DefaultRedactedParams = []string{"token", "access_token", "id_token", "password", "api_key", "secret"}
+
+var (
+	// sensitiveKeys are the names of the log attributes and of the headers never logged
+	sensitiveKeys = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "token", "password", "secret", "x-api-key"}
+
+	jwtRegexp         = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*(\.[A-Za-z0-9_-]*)?`)
+	userinfoRegexp    = regexp.MustCompile(`([A-Za-z][A-Za-z0-9+.-]*://)[^/?#@\s]*@`)
+	credentialsRegexp = regexp.MustCompile(`(?i)\b(Bearer|Basic)\s+[A-Za-z0-9._~+/=-]+`)
+)
+
+// Redactor removes the credentials and the sensitive query parameters from the logged values
+type Redactor struct {
+	paramsRegexp *regexp.Regexp
+}
+
+// NewRedactor creates a Redactor removing the values of the given query parameters, case-insensitively
+func NewRedactor(params []string) *Redactor {
+	redactor := &Redactor{}
+	quoted := make([]string, 0, len(params))
+	for _, param := range params {
+		if param != "" {
+			quoted = append(quoted, regexp.QuoteMeta(param))
+		}
+	}
+	if len(quoted) > 0 {
+		// The parameters are matched in URLs, and in the form values logged by the errors
+		redactor.paramsRegexp = regexp.MustCompile(`(?i)(^|[?&;\s"'])(` + strings.Join(quoted, "|") + `)=[^&;\s"']*`)
+	}
+	return redactor
+}
+
+// String returns s without tokens, URL credentials, authorization values and sensitive query parameters
+func (r *Redactor) String(s string) string {
+	s = jwtRegexp.ReplaceAllString(s, redacted)
+	s = userinfoRegexp.ReplaceAllString(s, "${1}"+redacted+"@")
+	s = credentialsRegexp.ReplaceAllString(s, "$1 "+redacted)
+	if r.paramsRegexp != nil {
+		s = r.paramsRegexp.ReplaceAllString(s, "${1}${2}="+redacted)
+	}
+	return s
+}
+
+// Header returns a copy of the header without the sensitive values
+func (r *Redactor) Header(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		if isSensitive(name) {
+			clone[name] = []string{redacted}
+			continue
+		}
+		clone[name] = make([]string, 0, len(values))
+		for _, value := range values {
+			clone[name] = append(clone[name], r.String(value))
+		}
+	}
+	return clone
+}
+
+// ReplaceAttr redacts the log attributes, see slog.HandlerOptions
+func (r *Redactor) ReplaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.String(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case *url.URL:
+			return slog.String(a.Key, r.String(v.String()))
+		case url.Values:
+			return slog.String(a.Key, r.String(v.Encode()))
+		case http.Header:
+			return slog.Any(a.Key, r.Header(v))
+		case error:
+			return slog.String(a.Key, r.String(v.Error()))
+		}
+	}
+	return a
+}
+
+func isSensitive(key string) bool {
+	for _, sensitive := range sensitiveKeys {
+		if strings.EqualFold(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// RequestIDHeader is the header carrying the id of the request
+	RequestIDHeader = "X-Request-ID"
+	// maxRequestIDLength is the maximum length of the request ids accepted from the clients
+	maxRequestIDLength = 128
+)
+
+// RequestIDHandler can be used as a middleware chain to identify every request with the
+// X-Request-ID header of the client, or a generated id. The id is returned in the response,
+// forwarded to Prometheus and logged.
+func RequestIDHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !isValidRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		handler(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	}
+}
+
+// requestID returns the id of the request, empty if not identified by RequestIDHandler
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// isValidRequestID returns true for the non-empty ids made of printable ASCII characters,
+// so that clients cannot forge log lines or headers
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
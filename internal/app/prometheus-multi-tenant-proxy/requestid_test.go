@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestID_RequestIDHandler(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		header   string
+		accepted bool
+	}{
+		{"generated", "", false},
+		{"from client", "abc-123", true},
+		{"uuid", "0b4bd9a6-7d36-4bce-9f0a-8b9ad2d3b1a4", true},
+		{"line break", "abc\nlevel=ERROR", false},
+		{"space", "abc def", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var id string
+			handler := RequestIDHandler(func(w http.ResponseWriter, r *http.Request) {
+				id = requestID(r.Context())
+			})
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			if tc.header != "" {
+				r.Header.Set(RequestIDHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if tc.accepted && id != tc.header {
+				t.Errorf("Request id of the client should be kept, got %q", id)
+			}
+			if !tc.accepted {
+				if _, err := uuid.Parse(id); err != nil {
+					t.Errorf("Request id should be generated, got %q", id)
+				}
+			}
+			if w.Header().Get(RequestIDHeader) != id {
+				t.Errorf("Request id should be returned, got %q expected %q", w.Header().Get(RequestIDHeader), id)
+			}
+		})
+	}
+}
+
+func TestRequestID_Forwarded(t *testing.T) {
+	tripper := ReversePrometheusRoundTripper{
+		prometheusServerURL: base,
+	}
+	var forwarded string
+	handler := RequestIDHandler(func(w http.ResponseWriter, r *http.Request) {
+		c := context.WithValue(r.Context(), Namespaces, []string{"ns1"})
+		c = context.WithValue(c, Labels, map[string][]string{})
+		r = r.WithContext(c)
+		tripper.Director(r)
+		forwarded = r.Header.Get(RequestIDHeader)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	r.Header.Set(RequestIDHeader, "abc\nxyz")
+	handler(httptest.NewRecorder(), r)
+	if _, err := uuid.Parse(forwarded); err != nil {
+		t.Errorf("Generated request id should be forwarded, got %q", forwarded)
+	}
+}
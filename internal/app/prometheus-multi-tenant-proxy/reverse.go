@@ -1,35 +1,96 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
 	injector "github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultTenantLabel is the label holding the namespaces of the tenants
+const DefaultTenantLabel = "namespace"
+
 type ReversePrometheusRoundTripper struct {
 	prometheusServerURL *url.URL
+	// tenantLabel is the label the namespaces are enforced on, DefaultTenantLabel if empty
+	tenantLabel string
+	// transport sends the requests to Prometheus, http.DefaultTransport if nil
+	transport http.RoundTripper
 }
 
 func (r *ReversePrometheusRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	log.Printf("[TO]\t%s %s %s\n", req.RemoteAddr, req.Method, req.URL)
-	return http.DefaultTransport.RoundTrip(req)
+	if err, ok := req.Context().Value(rejectionKey).(error); ok {
+		return nil, err
+	}
+	ctx, span := tracer().Start(req.Context(), "upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	// The trace context is propagated to Prometheus
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	requestLogger(req.Context()).Debug("Forwarding request", "method", req.Method, "url", req.URL)
+	resp, err := r.getTransport().RoundTrip(req)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	span.End()
+	return resp, nil
+}
+
+// ErrorHandler writes the response of the requests that could not be forwarded:
+// a 400 Bad Request for rejected queries, and a 502 Bad Gateway otherwise
+func (r *ReversePrometheusRoundTripper) ErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		requestLogger(req.Context()).Warn("Rejected query", "err", err)
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	requestLogger(req.Context()).Error("Upstream error", "err", err)
+	upstreamErrors.Inc()
+	writeErrorResponse(w, http.StatusBadGateway, "upstream error")
 }
 
 func (r *ReversePrometheusRoundTripper) Director(req *http.Request) {
 	if strings.HasSuffix(req.URL.Path, "/api/v1/query") || strings.HasSuffix(req.URL.Path, "/api/v1/query_range") {
 		if err := r.modifyRequest(req, "query"); err != nil {
-			log.Printf("[ERROR]\t%s\n", err)
+			rejectRequest(req, err)
 		}
 	}
 	if strings.HasSuffix(req.URL.Path, "/api/v1/series") {
 		if err := r.modifyRequest(req, "match[]"); err != nil {
-			log.Printf("[ERROR]\t%s\n", err)
+			rejectRequest(req, err)
+		}
+	}
+	if isLabelsPath(req.URL.Path) {
+		// Only the time range is restricted
+		if err := r.modifyRequest(req, ""); err != nil {
+			rejectRequest(req, err)
 		}
 	}
 
@@ -39,11 +100,19 @@ func (r *ReversePrometheusRoundTripper) Director(req *http.Request) {
 	req.URL.Path = r.prometheusServerURL.Path + req.URL.Path
 
 	req.Header.Set("X-Forwarded-Host", req.Host)
+	if id := requestID(req.Context()); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
 	req.Header.Del("Authorization")
 	req.Header.Del("Token")
 }
 
-func (r *ReversePrometheusRoundTripper) modifyRequest(req *http.Request, prometheusFormParameter string) error {
+func (r *ReversePrometheusRoundTripper) modifyRequest(req *http.Request, prometheusFormParameter string) (err error) {
+	_, span := tracer().Start(req.Context(), "rewrite", trace.WithAttributes(
+		attribute.String("http.route", endpointLabel(req.URL.Path)),
+		attribute.String("promql.param", prometheusFormParameter),
+	))
+	defer func() { endSpan(span, err) }()
 
 	namespaces := req.Context().Value(Namespaces).([]string)
 	l := req.Context().Value(Labels).(map[string][]string)
@@ -52,31 +121,32 @@ func (r *ReversePrometheusRoundTripper) modifyRequest(req *http.Request, prometh
 	var labelMatchers []*labels.Matcher
 
 	for k, v := range l {
-		combinedValue := strings.Join(v, "|")
-		labelMatchers = append(labelMatchers, &labels.Matcher{
-			Name:  k,
-			Type:  labels.MatchRegexp,
-			Value: combinedValue,
-		})
-	}
-
-	if len(namespaces) == 1 {
-		// If there is only one namespace, we can use the more efficient MatchEqual matcher.
-		labelMatchers = append(labelMatchers, &labels.Matcher{
-			Name:  "namespace",
-			Type:  labels.MatchEqual,
-			Value: namespaces[0],
-		})
-	} else if len(namespaces) > 1 {
-		// If there are multiple namespaces, we need to use the MatchRegexp matcher.
-		labelMatchers = append(labelMatchers, &labels.Matcher{
-			Name:  "namespace",
-			Type:  labels.MatchRegexp,
-			Value: strings.Join(namespaces, "|"),
-		})
+		labelMatchers = append(labelMatchers, regexpMatcher(k, v, false))
+	}
+
+	if len(namespaces) > 0 {
+		labelMatchers = append(labelMatchers, valuesMatcher(r.getTenantLabel(), namespaces, false))
+	}
+
+	// Negative matchers are enforced separately: the enforcer keeps a single
+	// matcher per label name, and they must not replace the positive ones.
+	excludedNamespaces, _ := req.Context().Value(ExcludedNamespaces).([]string)
+	excludedLabels, _ := req.Context().Value(ExcludedLabels).(map[string][]string)
+	var excludedMatchers []*labels.Matcher
+
+	for k, v := range excludedLabels {
+		excludedMatchers = append(excludedMatchers, valuesMatcher(k, v, true))
+	}
+	if len(excludedNamespaces) > 0 {
+		excludedMatchers = append(excludedMatchers, valuesMatcher(r.getTenantLabel(), excludedNamespaces, true))
 	}
 
+	var limits *pkg.QueryLimits
+	if identity, ok := req.Context().Value(IdentityKey).(*Identity); ok {
+		limits = identity.QueryLimits
+	}
 	e := injector.NewPromQLEnforcer(false, labelMatchers...)
+	excluded := injector.NewPromQLEnforcer(false, excludedMatchers...)
 
 	if err := req.ParseForm(); err != nil {
 		return err
@@ -84,25 +154,63 @@ func (r *ReversePrometheusRoundTripper) modifyRequest(req *http.Request, prometh
 
 	form := req.Form
 
+	record := auditRecord(req.Context())
+	if record != nil {
+		// The time range is audited once restricted, even if the request is rejected
+		defer func() {
+			record.Start, record.End, record.EvalTime = form.Get("start"), form.Get("end"), form.Get("time")
+		}()
+	}
+
+	instant := strings.HasSuffix(req.URL.Path, "/api/v1/query")
+	now := time.Now()
+	if err := limitTimeRange(form, instant, now, limits); err != nil {
+		return err
+	}
+	if err := checkQueryRange(form, limits); err != nil {
+		return err
+	}
+
 	for key, values := range form {
 		value := values[0]
 		if key == prometheusFormParameter {
+			// Rejected queries are audited too, without enforced expression
+			var audited *AuditQuery
+			if record != nil {
+				record.Queries = append(record.Queries, AuditQuery{Param: key, Original: value})
+				audited = &record.Queries[len(record.Queries)-1]
+			}
 			expr, err := parser.ParseExpr(value)
 			if err != nil {
 				return err
 			}
-			log.Printf("[QUERY]\t%s ORIGINAL: %s\n", req.RemoteAddr, expr)
-			if len(namespaces) == 0 && len(l) == 0 {
-				log.Printf("[ERROR]\t%s\n", "no namespaces or labels found in request context")
+			requestLogger(req.Context()).Debug("Original query", "param", key, "query", expr)
+			if err := checkExpr(expr, limits); err != nil {
+				return err
+			}
+			if err := limitLookback(expr, form, instant, now, limits); err != nil {
+				return err
+			}
+			if len(labelMatchers) == 0 && len(excludedMatchers) == 0 {
+				requestLogger(req.Context()).Error("No namespaces or labels found in request context")
 				// This is a hack to prevent the query from being executed.
 				value = ""
 			} else {
 				if err := e.EnforceNode(expr); err != nil {
 					return err
 				}
+				if err := excluded.EnforceNode(expr); err != nil {
+					return err
+				}
+				if err := enforceDeniedMetrics(expr, limits); err != nil {
+					return err
+				}
 				value = expr.String()
 			}
-			log.Printf("[QUERY]\t%s MODIFIED: %s\n", req.RemoteAddr, value)
+			requestLogger(req.Context()).Debug("Modified query", "param", key, "query", value)
+			if audited != nil {
+				audited.Enforced = value
+			}
 		}
 		form.Set(key, value)
 	}
@@ -119,3 +227,72 @@ func (r *ReversePrometheusRoundTripper) modifyRequest(req *http.Request, prometh
 
 	return nil
 }
+
+// isLabelsPath returns true for the /api/v1/labels and /api/v1/label/<name>/values endpoints
+func isLabelsPath(p string) bool {
+	if strings.HasSuffix(p, "/api/v1/labels") {
+		return true
+	}
+	i := strings.LastIndex(p, "/api/v1/label/")
+	return i >= 0 && strings.HasSuffix(p, "/values") && strings.Count(p[i:], "/") == 5
+}
+
+// ValidateTenantLabel checks that the label the namespaces are enforced on is a valid label name,
+// other than the metric name
+func ValidateTenantLabel(label string) error {
+	if strings.TrimSpace(label) == "" {
+		return errors.New("tenant label cannot be empty")
+	}
+	if !model.LabelName(label).IsValid() {
+		return fmt.Errorf("invalid tenant label %q", label)
+	}
+	if label == model.MetricNameLabel {
+		return fmt.Errorf("tenant label cannot be the metric name %s", model.MetricNameLabel)
+	}
+	return nil
+}
+
+func (r *ReversePrometheusRoundTripper) getTenantLabel() string {
+	if r.tenantLabel == "" {
+		return DefaultTenantLabel
+	}
+	return r.tenantLabel
+}
+
+func (r *ReversePrometheusRoundTripper) getTransport() http.RoundTripper {
+	if r.transport == nil {
+		return http.DefaultTransport
+	}
+	return r.transport
+}
+
+// valuesMatcher returns a matcher selecting, or excluding if negative, any of the values.
+// A single literal value uses the more efficient (Not)Equal matcher.
+func valuesMatcher(name string, values []string, negative bool) *labels.Matcher {
+	if len(values) == 1 && !pkg.IsPattern(values[0]) {
+		matchType := labels.MatchEqual
+		if negative {
+			matchType = labels.MatchNotEqual
+		}
+		return &labels.Matcher{
+			Name:  name,
+			Type:  matchType,
+			Value: values[0],
+		}
+	}
+	return regexpMatcher(name, values, negative)
+}
+
+// regexpMatcher returns a (Not)Regexp matcher selecting, or excluding if negative, any of the values.
+// Literal values are escaped so that only patterns are interpreted as regular expressions.
+func regexpMatcher(name string, values []string, negative bool) *labels.Matcher {
+	matchType := labels.MatchRegexp
+	if negative {
+		matchType = labels.MatchNotRegexp
+	}
+	return &labels.Matcher{
+		Name:  name,
+		Type:  matchType,
+		Value: pkg.JoinRegexps(values...),
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 var (
@@ -143,6 +149,132 @@ func TestReverse_ModifyGet(t *testing.T) {
 	}
 }
 
+func TestReverse_Excluded(t *testing.T) {
+	tripper := ReversePrometheusRoundTripper{
+		prometheusServerURL: base,
+	}
+
+	testCases := []struct {
+		desc       string
+		namespaces []string
+		labels     map[string][]string
+		exNs       []string
+		exLabels   map[string][]string
+		expected   string
+	}{
+		{"one namespace", nil, nil, []string{"kube-system"}, nil, `up{namespace!="kube-system"}`},
+		{"two namespaces", nil, nil, []string{"kube-system", "monitoring"}, nil, `up{namespace!~"kube-system|monitoring"}`},
+		{"label", nil, nil, nil, map[string][]string{"sensitive": {"true"}}, `up{sensitive!="true"}`},
+		{"with namespace", []string{"ns1"}, nil, nil, map[string][]string{"sensitive": {"true"}}, `up{namespace="ns1",sensitive!="true"}`},
+		{"same label", nil, map[string][]string{"namespace": {"~team-.*"}}, []string{"team-secret"}, nil, `up{namespace!="team-secret",namespace=~"team-.*"}`},
+		{"pattern", nil, nil, []string{"~kube-.*"}, nil, `up{namespace!~"kube-.*"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := ctx(tc.namespaces, tc.labels)
+			c = context.WithValue(c, ExcludedNamespaces, tc.exNs)
+			c = context.WithValue(c, ExcludedLabels, tc.exLabels)
+			r, _ := http.NewRequest(http.MethodGet, promURL+"/api/v1/query?query=up", nil)
+			r = r.WithContext(c)
+			tripper.Director(r)
+
+			parsed, _ := url.QueryUnescape(r.URL.RawQuery)
+			if parsed != "query="+tc.expected {
+				t.Errorf("Wrong query: %s (expected %s)", parsed, tc.expected)
+			}
+		})
+	}
+}
+
+func TestReverse_Escaping(t *testing.T) {
+	tripper := ReversePrometheusRoundTripper{
+		prometheusServerURL: base,
+	}
+
+	testCases := []struct {
+		desc       string
+		namespaces []string
+		labels     map[string][]string
+		expected   string
+	}{
+		{"literal namespace", []string{"team.a"}, nil, `up{namespace="team.a"}`},
+		{"literal namespaces", []string{"team.a", "team+b"}, nil, `up{namespace=~"team\\.a|team\\+b"}`},
+		{"literal wildcard", []string{".*", "a"}, nil, `up{namespace=~"\\.\\*|a"}`},
+		{"pattern namespace", []string{"~team-a-.*"}, nil, `up{namespace=~"team-a-.*"}`},
+		{"pattern and literal", []string{"~team-a-.*", "(b)"}, nil, `up{namespace=~"(?:team-a-.*)|\\(b\\)"}`},
+		{"pattern flag and literal", []string{"~(?i)a", "b"}, nil, `up{namespace=~"(?:(?i)a)|b"}`},
+		{"literal label", nil, map[string][]string{"app": {"a.b"}}, `up{app=~"a\\.b"}`},
+		{"pattern label", nil, map[string][]string{"app": {"~shop-.+"}}, `up{app=~"shop-.+"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := getRequest(promURL+"/api/v1/query?query=up", tc.namespaces, tc.labels)
+			tripper.Director(r)
+
+			parsed, _ := url.QueryUnescape(r.URL.RawQuery)
+			if parsed != "query="+tc.expected {
+				t.Errorf("Wrong query: %s (expected %s)", parsed, tc.expected)
+			}
+		})
+	}
+}
+
+func TestReverse_ValidateTenantLabel(t *testing.T) {
+	testCases := []struct {
+		label string
+		ok    bool
+	}{
+		{"namespace", true},
+		{"kubernetes_namespace", true},
+		{"_tenant2", true},
+		{"", false},
+		{"  ", false},
+		{" namespace", false},
+		{"kubernetes-namespace", false},
+		{"2tenant", false},
+		{"__name__", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.label, func(t *testing.T) {
+			if err := ValidateTenantLabel(tc.label); (err == nil) != tc.ok {
+				t.Errorf("ValidateTenantLabel(%q) = %v, expected ok=%v", tc.label, err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestReverse_TenantLabel(t *testing.T) {
+	testCases := []struct {
+		tenantLabel string
+		expected    string
+	}{
+		{"", `up{namespace!="ns2",namespace="ns1"}`},
+		{"kubernetes_namespace", `up{kubernetes_namespace!="ns2",kubernetes_namespace="ns1"}`},
+		{"tenant", `up{tenant!="ns2",tenant="ns1"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.tenantLabel, func(t *testing.T) {
+			tripper := ReversePrometheusRoundTripper{
+				prometheusServerURL: base,
+				tenantLabel:         tc.tenantLabel,
+			}
+			c := context.WithValue(ctx([]string{"ns1"}, nil), ExcludedNamespaces, []string{"ns2"})
+			r, _ := http.NewRequest(http.MethodGet, promURL+"/api/v1/query?query=up", nil)
+			r = r.WithContext(c)
+			tripper.Director(r)
+
+			parsed, _ := url.QueryUnescape(r.URL.RawQuery)
+			if parsed != "query="+tc.expected {
+				t.Errorf("Wrong query: %s (expected %s)", parsed, tc.expected)
+			}
+		})
+	}
+}
+
 func TestReverse_NoNs(t *testing.T) {
 	// A request without namespaces nor labels
 	// will end up with a query string containing an empty prometheus query.
@@ -206,3 +338,168 @@ func TestReverse_Untouched(t *testing.T) {
 	}
 
 }
+
+func TestReverse_Rejected(t *testing.T) {
+	tripper := ReversePrometheusRoundTripper{
+		prometheusServerURL: base,
+	}
+	limits := &pkg.QueryLimits{RequireMetricName: true, MinStep: model.Duration(time.Minute)}
+
+	testCases := []struct {
+		desc   string
+		query  string
+		status int
+	}{
+		{"invalid query", "query?query=up{", http.StatusBadRequest},
+		{"no metric name", `query?query={job="a"}`, http.StatusBadRequest},
+		{"tiny step", "query_range?query=up&start=1700000000&end=1700003600&step=15", http.StatusBadRequest},
+		{"series without metric name", `series?match[]={job="a"}`, http.StatusBadRequest},
+		{"valid query", "query?query=up", http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := context.WithValue(ctx([]string{"ns1"}, nil), IdentityKey, &Identity{QueryLimits: limits})
+			r, _ := http.NewRequest(http.MethodGet, promURL+"/api/v1/"+tc.query, nil)
+			r = r.WithContext(c)
+			tripper.Director(r)
+			// Forwarded requests fail as the upstream does not exist
+			r.URL.Host = "127.0.0.1:1"
+
+			w := httptest.NewRecorder()
+			if _, err := tripper.RoundTrip(r); err != nil {
+				tripper.ErrorHandler(w, r, err)
+			}
+			if w.Code != tc.status {
+				t.Errorf("Wrong status code: %d, expected %d: %s", w.Code, tc.status, w.Body.String())
+			}
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestReverse_Transport(t *testing.T) {
+	var forwarded *http.Request
+	tripper := ReversePrometheusRoundTripper{
+		prometheusServerURL: base,
+		transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			forwarded = r
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	r, _ := http.NewRequest(http.MethodGet, promURL+"/api/v1/query?query=up", nil)
+	r = r.WithContext(ctx([]string{"ns1"}, nil))
+	tripper.Director(r)
+	if _, err := tripper.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded == nil || forwarded.URL.Host != base.Host {
+		t.Errorf("The request should be sent with the transport of the tripper: %v", forwarded)
+	}
+	if (&ReversePrometheusRoundTripper{}).getTransport() != http.DefaultTransport {
+		t.Error("The default transport should be used if none is set")
+	}
+}
+
+func TestReverse_isLabelsPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected bool
+	}{
+		{"/api/v1/labels", true},
+		{"/prometheus/api/v1/labels", true},
+		{"/api/v1/label/job/values", true},
+		{"/api/v1/label/values", false},
+		{"/api/v1/label/job/foo/values", false},
+		{"/api/v1/series", false},
+	}
+
+	for _, tc := range testCases {
+		if isLabelsPath(tc.path) != tc.expected {
+			t.Errorf("isLabelsPath(%s) != %v", tc.path, tc.expected)
+		}
+	}
+}
+
+func TestReverse_TimeRange(t *testing.T) {
+	tripper := ReversePrometheusRoundTripper{
+		prometheusServerURL: base,
+	}
+	limits := &pkg.QueryLimits{MaxLookback: model.Duration(24 * time.Hour)}
+
+	testCases := []string{
+		"query?query=up&time=0",
+		"query_range?query=up&start=0&end=1&step=1",
+		"query?query=" + url.QueryEscape("up offset 2d"),
+		"query?query=" + url.QueryEscape("max_over_time(up[2d])"),
+		"query?query=" + url.QueryEscape("up @ 0"),
+		"query_range?query=" + url.QueryEscape("max_over_time(up[1d:1m] offset 1d)") + "&step=60",
+		"series?match[]=up&start=0",
+		"labels?start=0",
+		"label/job/values?start=0",
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc, func(t *testing.T) {
+			c := context.WithValue(ctx([]string{"ns1"}, nil), IdentityKey, &Identity{QueryLimits: limits})
+			r, _ := http.NewRequest(http.MethodGet, promURL+"/api/v1/"+tc, nil)
+			r = r.WithContext(c)
+			tripper.Director(r)
+			if _, ok := r.Context().Value(rejectionKey).(error); !ok {
+				t.Errorf("Request older than the lookback limit should be rejected")
+			}
+		})
+	}
+}
+
+func TestReverse_DeniedMetrics(t *testing.T) {
+	tripper := ReversePrometheusRoundTripper{
+		prometheusServerURL: base,
+	}
+
+	testCases := []struct {
+		desc     string
+		limits   *pkg.QueryLimits
+		query    string
+		expected string
+	}{
+		{"allowed", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}}, `up`, `up{namespace="ns1"}`},
+		{"allowed range", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}}, `rate(http_requests_total[5m])`, `rate(http_requests_total{namespace="ns1"}[5m])`},
+		{"name pattern", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}}, `{__name__=~".+"}`, `{__name__!~"etcd_.*",__name__=~".+",namespace="ns1"}`},
+		{"without name", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}}, `{job="etcd"}`, `{__name__!~"etcd_.*",job="etcd",namespace="ns1"}`},
+		{"stripped", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}, StripDeniedMetrics: true}, `etcd_db_total_size_in_bytes`, `{__name__!~"etcd_.*",__name__="etcd_db_total_size_in_bytes",namespace="ns1"}`},
+		{"stripped name matcher", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}, StripDeniedMetrics: true}, `{__name__="etcd_db_total_size_in_bytes"}`, `{__name__!~"etcd_.*",__name__="etcd_db_total_size_in_bytes",namespace="ns1"}`},
+		{"stripped range", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}, StripDeniedMetrics: true}, `up + rate(etcd_disk_wal_fsync_duration_seconds_count[5m])`, `up{namespace="ns1"} + rate({__name__!~"etcd_.*",__name__="etcd_disk_wal_fsync_duration_seconds_count",namespace="ns1"}[5m])`},
+		{"rejected", &pkg.QueryLimits{DeniedMetrics: []string{"~etcd_.*"}}, `etcd_db_total_size_in_bytes`, ""},
+		{"denied function", &pkg.QueryLimits{DeniedFunctions: []string{"count_values"}}, `count_values("v", up)`, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := context.WithValue(ctx([]string{"ns1"}, nil), IdentityKey, &Identity{QueryLimits: tc.limits})
+			r, _ := http.NewRequest(http.MethodGet, promURL+"/api/v1/query?query="+url.QueryEscape(tc.query), nil)
+			r = r.WithContext(c)
+			tripper.Director(r)
+
+			_, rejected := r.Context().Value(rejectionKey).(error)
+			if rejected != (tc.expected == "") {
+				t.Fatalf("Request rejected=%v, expected %v", rejected, tc.expected == "")
+			}
+			if rejected {
+				return
+			}
+			parsed, _ := url.QueryUnescape(r.URL.RawQuery)
+			if parsed != "query="+tc.expected {
+				t.Errorf("Wrong query: %s (expected %s)", parsed, tc.expected)
+			}
+			if _, err := parser.ParseExpr(r.URL.Query().Get("query")); err != nil {
+				t.Errorf("Rewritten query is invalid: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// RouteMatcher matches request paths against a list of endpoint patterns:
+//   - "*" matches all the paths,
+//   - a pattern ending with "/**" matches the path before it and all its sub-paths,
+//   - a pattern containing "*", "?" or "[" is a glob matched with path.Match,
+//     where "*" never matches a "/",
+//   - any other pattern matches the exact path.
+//
+// Request paths must start with the route prefix, which is removed before matching.
+// Paths that are not canonical (e.g. containing "//", "." or ".." segments or
+// a trailing "/") never match.
+type RouteMatcher struct {
+	prefix   string
+	patterns []string
+	// all matches every path, even outside the prefix or not canonical
+	all bool
+}
+
+// NewRouteMatcher creates a RouteMatcher for paths served under prefix
+func NewRouteMatcher(prefix string, patterns []string) *RouteMatcher {
+	return &RouteMatcher{
+		prefix:   strings.TrimSuffix(prefix, "/"),
+		patterns: patterns,
+	}
+}
+
+// NewAllowAllRouteMatcher creates a RouteMatcher matching every path, which only
+// keeps the prefix for the RouteMatchers created from it with WithPatterns
+func NewAllowAllRouteMatcher(prefix string) *RouteMatcher {
+	matcher := NewRouteMatcher(prefix, nil)
+	matcher.all = true
+	return matcher
+}
+
+// WithPatterns returns a RouteMatcher sharing the prefix of m, with other patterns
+func (m *RouteMatcher) WithPatterns(patterns []string) *RouteMatcher {
+	if m == nil {
+		return NewRouteMatcher("", patterns)
+	}
+	return NewRouteMatcher(m.prefix, patterns)
+}
+
+// Match returns true if the request path matches one of the patterns
+func (m *RouteMatcher) Match(requestPath string) bool {
+	if m.all {
+		return true
+	}
+	routePath, ok := m.routePath(requestPath)
+	if !ok {
+		return false
+	}
+	for _, pattern := range m.patterns {
+		if matchRoute(pattern, routePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteHandler serves the requests matching the unprotected endpoints with
+// unprotectedHandler and all the other requests with protectedHandler
+func RouteHandler(unprotected *RouteMatcher, unprotectedHandler, protectedHandler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if unprotected.Match(r.URL.Path) {
+			unprotectedHandler(w, r)
+			return
+		}
+		protectedHandler(w, r)
+	}
+}
+
+// routePath returns the request path without the route prefix
+func (m *RouteMatcher) routePath(requestPath string) (string, bool) {
+	if requestPath == "" || path.Clean(requestPath) != requestPath {
+		return "", false
+	}
+	if m.prefix == "" {
+		return requestPath, true
+	}
+	routePath := strings.TrimPrefix(requestPath, m.prefix)
+	if routePath == requestPath || !strings.HasPrefix(routePath, "/") {
+		// Outside of the prefix, or sharing only the beginning of its last segment
+		return "", false
+	}
+	return routePath, true
+}
+
+func matchRoute(pattern, routePath string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if base, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return routePath == base || strings.HasPrefix(routePath, base+"/")
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, err := path.Match(pattern, routePath)
+		return err == nil && matched
+	}
+	return pattern == routePath
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutes_Match(t *testing.T) {
+	patterns := []string{
+		"/api/v1/query",
+		"/api/v1/label/*/values",
+		"/-/healthy",
+		"/federate/**",
+	}
+
+	testCases := []struct {
+		prefix   string
+		path     string
+		expected bool
+	}{
+		{"", "", false},
+		{"", "/api/v1/query", true},
+		{"", "/api/v1/query_range", false},
+		{"", "/api/v2/query", false},
+		{"", "/v1/query", false},
+		// bypass attempts
+		{"", "/foo/api/v1/query", false},
+		{"", "/evil/-/healthy", false},
+		{"", "/api/v1/query/", false},
+		{"", "/api/v1/query/..", false},
+		{"", "/api/v1/status/../query", false},
+		{"", "//api/v1/query", false},
+		{"", "/./api/v1/query", false},
+		{"", "/-/healthy/../../api/v1/admin/tsdb/delete_series", false},
+		{"", "api/v1/query", false},
+		// glob
+		{"", "/api/v1/label/job/values", true},
+		{"", "/api/v1/label/job/foo/values", false},
+		{"", "/api/v1/label/values", false},
+		// prefix
+		{"", "/federate", true},
+		{"", "/federate/some/path", true},
+		{"", "/federated", false},
+		// route prefix
+		{"/prometheus", "/prometheus/api/v1/query", true},
+		{"/prometheus/", "/prometheus/api/v1/query", true},
+		{"/prometheus", "/api/v1/query", false},
+		{"/prometheus", "/prometheus-evil/api/v1/query", false},
+		{"/prometheus", "/other/prometheus/api/v1/query", false},
+		{"/prometheus", "/prometheus/-/healthy", true},
+		{"/prometheus", "/prometheus", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s%s", tc.prefix, tc.path), func(t *testing.T) {
+			if matched := NewRouteMatcher(tc.prefix, patterns).Match(tc.path); matched != tc.expected {
+				t.Errorf("Match(%q) with prefix %q = %v, expected %v", tc.path, tc.prefix, matched, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRoutes_MatchAll(t *testing.T) {
+	m := NewRouteMatcher("/prometheus", []string{"*"})
+	if !m.Match("/prometheus/api/v1/status/config") {
+		t.Errorf("* should match all the paths under the prefix")
+	}
+	if m.Match("/api/v1/status/config") {
+		t.Errorf("* should not match paths outside the prefix")
+	}
+	if NewRouteMatcher("", []string{}).Match("/api/v1/query") {
+		t.Errorf("No pattern should match nothing")
+	}
+}
+
+func TestRoutes_WithPatterns(t *testing.T) {
+	var m *RouteMatcher
+	if !m.WithPatterns([]string{"/api/v1/read"}).Match("/api/v1/read") {
+		t.Errorf("nil matcher should have no prefix")
+	}
+	m = NewRouteMatcher("/prometheus", []string{"/api/v1/query"})
+	if !m.WithPatterns([]string{"/api/v1/read"}).Match("/prometheus/api/v1/read") {
+		t.Errorf("prefix should be kept")
+	}
+}
+
+func TestRoutes_AllowAll(t *testing.T) {
+	m := NewAllowAllRouteMatcher("/prometheus")
+	for _, p := range []string{"/prometheus/api/v1/query", "/api/v1/query", "/prometheus//api/v1/query"} {
+		if !m.Match(p) {
+			t.Errorf("%s should match", p)
+		}
+	}
+	endpoints := m.WithPatterns([]string{"/api/v1/query"})
+	if !endpoints.Match("/prometheus/api/v1/query") {
+		t.Errorf("prefix should be kept")
+	}
+	if endpoints.Match("/api/v1/query") || endpoints.Match("/prometheus/api/v1/series") {
+		t.Errorf("only the patterns should match")
+	}
+}
+
+func TestRoutes_RouteHandler(t *testing.T) {
+	unprotected := NewRouteMatcher("", []string{"/-/healthy", "/-/ready"})
+
+	testCases := []struct {
+		path        string
+		unprotected bool
+	}{
+		{"/-/healthy", true},
+		{"/-/ready", true},
+		{"/-/healthy/../../api/v1/query", false},
+		{"/-/ready/", false},
+		{"/api/v1/query", false},
+		{"/foo/-/healthy", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			served := ""
+			h := RouteHandler(unprotected,
+				func(w http.ResponseWriter, r *http.Request) { served = "unprotected" },
+				func(w http.ResponseWriter, r *http.Request) { served = "protected" },
+			)
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.URL.Path = tc.path
+			h(httptest.NewRecorder(), r)
+			if (served == "unprotected") != tc.unprotected {
+				t.Errorf("%s served as %s", tc.path, served)
+			}
+		})
+	}
+}
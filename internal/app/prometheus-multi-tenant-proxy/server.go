@@ -1,43 +1,82 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/k8spin/prometheus-multi-tenant-proxy/internal/pkg"
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel"
 )
 
 // Serve serves
 func Serve(c *cli.Context) error {
+	redactor := NewRedactor(c.StringSlice("redact-query-params"))
+	logger, err := NewLogger(os.Stderr, c.String("log-format"), c.String("log-level"), redactor)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(c.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if otlpEndpoint := c.String("otlp-endpoint"); otlpEndpoint != "" {
+		tracerProvider, err := NewTracerProvider(ctx, otlpEndpoint, c.Float64("trace-sample-ratio"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		defer tracerProvider.Shutdown(context.Background())
+		otel.SetTracerProvider(tracerProvider)
+		slog.Info("Tracing enabled", "endpoint", otlpEndpoint)
+	}
+
 	prometheusServerURL, _ := url.Parse(c.String("prometheus-endpoint"))
 	serveAt := fmt.Sprintf(":%d", c.Int("port"))
-	authConfigLocation := c.String("auth-config")
+	authConfigLocations := c.StringSlice("auth-config")
 	reloadInterval := c.Int("reload-interval")
-	authType := c.String("auth-type")
+	authTypes := c.StringSlice("auth-type")
 	awsSign := c.Bool("aws")
 
-	var auth Auth
-	if authType == "basic" {
-		auth = NewBasicAuth(authConfigLocation)
-	} else if authType == "jwt" {
-		auth = NewJwtAuth(authConfigLocation)
-	} else {
-		log.Fatalf("auth-type must be one of: basic, jwt") // will exit
+	if len(authTypes) != len(authConfigLocations) {
+		fatal("auth-config must contain one location per auth-type",
+			"auth_types", len(authTypes), "auth_configs", len(authConfigLocations)) // will exit
+	}
+	auths := make([]Auth, 0, len(authTypes))
+	for i, authType := range authTypes {
+		auths = append(auths, newAuth(authType, authConfigLocations[i]))
+	}
+	var auth Auth = NewChainAuth(auths...)
+	if len(auths) == 1 {
+		auth = auths[0]
+	}
+	slog.Info("Auth mechanisms", "auth_types", authTypes)
+	if policyLocation := c.String("policy-config"); policyLocation != "" {
+		auth = NewPolicyAuth(auth, policyLocation)
+		slog.Info("Authorization policy enabled", "file", policyLocation)
 	}
 
+	// The backends exit if the configuration cannot be loaded at startup
+	configLastReloadSuccess.SetToCurrentTime()
+
 	if reloadInterval > 0 {
 		ticker := time.NewTicker(time.Duration(reloadInterval) * time.Minute)
-		quit := make(chan struct{})
 		go func() {
 			for {
 				select {
 				case <-ticker.C:
-					auth.Load()
-				case <-quit:
+					observeReload(auth.Load())
+				case <-ctx.Done():
 					ticker.Stop()
 					return
 				}
@@ -45,41 +84,172 @@ func Serve(c *cli.Context) error {
 		}()
 	}
 
+	transport, err := NewUpstreamTransport(UpstreamOptions{
+		CAFile:                c.String("upstream-ca-file"),
+		CertFile:              c.String("upstream-cert-file"),
+		KeyFile:               c.String("upstream-key-file"),
+		ServerName:            c.String("upstream-server-name"),
+		InsecureSkipVerify:    c.Bool("upstream-insecure-skip-verify"),
+		MaxIdleConns:          c.Int("upstream-max-idle-conns"),
+		MaxIdleConnsPerHost:   c.Int("upstream-max-idle-conns-per-host"),
+		MaxConnsPerHost:       c.Int("upstream-max-conns-per-host"),
+		IdleConnTimeout:       c.Duration("upstream-idle-conn-timeout"),
+		DialTimeout:           c.Duration("upstream-dial-timeout"),
+		TLSHandshakeTimeout:   c.Duration("upstream-tls-handshake-timeout"),
+		ResponseHeaderTimeout: c.Duration("upstream-response-header-timeout"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if c.Bool("upstream-insecure-skip-verify") {
+		slog.Warn("Not verifying the certificate of Prometheus! This is highly insecure.")
+	}
+
+	tenantLabel := c.String("tenant-label")
+	if err := ValidateTenantLabel(tenantLabel); err != nil {
+		return cli.Exit(err, 1)
+	}
 	rprt := ReversePrometheusRoundTripper{
 		prometheusServerURL: prometheusServerURL,
+		tenantLabel:         tenantLabel,
+		transport:           transport,
 	}
+	slog.Info("Namespaces enforced on label", "label", rprt.getTenantLabel())
 
 	director := rprt.Director
 
 	if awsSign {
 		signer := NewAWSSigner()
 		director = signer.SignAfter(director)
-		log.Printf("AWS signature enabled: %v", signer)
+		slog.Info("AWS signature enabled", "signer", signer)
 	}
 
 	reverseProxy := httputil.ReverseProxy{
-		Director:  director,
-		Transport: &rprt,
+		Director:     director,
+		Transport:    &rprt,
+		ErrorHandler: rprt.ErrorHandler,
 	}
 
-	for _, selected := range c.StringSlice("unprotected-endpoints") {
-		log.Printf("Serving as unprotected endpoint: %s", selected)
-		http.HandleFunc(selected, LogRequest(reverseProxy.ServeHTTP))
+	routePrefix := c.String("route-prefix")
+	if routePrefix != "" {
+		slog.Info("Matching endpoints under route prefix", "prefix", routePrefix)
 	}
 
-	whitelist := c.StringSlice("protected-endpoints")
-	if len(whitelist) == 1 && whitelist[0] == "" {
-		// turn off protection if --protected-endpoints "" is used
-		whitelist = nil
-		log.Printf("[WARNING] Allowing all endpoints! This is highly insecure.")
+	unprotectedEndpoints := c.StringSlice("unprotected-endpoints")
+	slog.Info("Serving as unprotected endpoints", "endpoints", unprotectedEndpoints)
+	unprotected := NewRouteMatcher(routePrefix, unprotectedEndpoints)
+
+	var whitelist *RouteMatcher
+	protectedEndpoints := c.StringSlice("protected-endpoints")
+	if len(protectedEndpoints) == 1 && protectedEndpoints[0] == "" {
+		// turn off protection if --protected-endpoints "" is used,
+		// the endpoints of the users are still matched under the route prefix
+		slog.Warn("Allowing all endpoints! This is highly insecure.")
+		whitelist = NewAllowAllRouteMatcher(routePrefix)
 	} else {
-		log.Printf("Allowed protected endpoints: %v", whitelist)
+		whitelist = NewRouteMatcher(routePrefix, protectedEndpoints)
+		slog.Info("Allowed protected endpoints", "endpoints", protectedEndpoints)
+	}
+
+	var defaultRateLimit *pkg.RateLimit
+	if rateLimit := c.Float64("rate-limit"); rateLimit > 0 {
+		defaultRateLimit = &pkg.RateLimit{
+			Rate:        rateLimit,
+			Burst:       c.Int("rate-limit-burst"),
+			PerEndpoint: c.Bool("rate-limit-per-endpoint"),
+		}
+		slog.Info("Default rate limit", "rate", defaultRateLimit.Rate, "burst", defaultRateLimit.GetBurst())
 	}
+	limiter := NewRateLimiter(defaultRateLimit)
+
+	concurrencyLimiter := NewConcurrencyLimiter(
+		c.Int("max-concurrent-requests"),
+		c.Int("max-concurrent-requests-per-user"),
+		c.Int("max-queued-requests"),
+		c.Duration("queue-timeout"),
+	)
+
+	var audit *AuditLogger
+	if auditLocation := c.String("audit-log"); auditLocation != "" {
+		audit = NewAuditLogger(auditLocation, c.Int("audit-log-max-size"), c.Int("audit-log-max-backups"), c.Int("audit-log-max-age"))
+		slog.Info("Audit log enabled", "file", auditLocation)
+	}
+
+	serverOptions := ServerOptions{
+		ReadTimeout:       c.Duration("read-timeout"),
+		ReadHeaderTimeout: c.Duration("read-header-timeout"),
+		WriteTimeout:      c.Duration("write-timeout"),
+		IdleTimeout:       c.Duration("idle-timeout"),
+		MaxHeaderBytes:    c.Int("max-header-bytes"),
+	}
+	shutdownTimeout := c.Duration("shutdown-timeout")
+
+	if metricsListenAddress := c.String("metrics-listen-address"); metricsListenAddress != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", MetricsHandler())
+		metricsServer := NewServer(metricsListenAddress, metricsMux, serverOptions)
+		metricsListener, err := net.Listen("tcp", metricsListenAddress)
+		if err != nil {
+			fatal("Metrics endpoint can not start", "err", err)
+		}
+		go func() {
+			slog.Info("Serving metrics", "address", metricsListenAddress)
+			if err := ServeUntilDone(ctx, metricsServer, metricsListener, nil, 0, shutdownTimeout); err != nil {
+				slog.Error("Metrics endpoint stopped", "err", err)
+			}
+		}()
+	}
+
+	draining := new(atomic.Bool)
+	readiness := NewRouteMatcher(routePrefix, []string{"/-/ready", ProxyReadyPath})
+	healthOptions := HealthOptions{MaxConfigAge: c.Duration("readiness-max-config-age"), Transport: transport}
+	if c.Bool("readiness-check-upstream") {
+		healthOptions.Upstream = prometheusServerURL
+		slog.Info("Readiness checks the upstream", "url", prometheusServerURL)
+	}
+	health := NewHealth(auth, routePrefix, healthOptions)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", DrainHandler(draining, readiness, HealthHandler(health, TraceRequest(RequestIDHandler(LogRequest(InstrumentRequest(RouteHandler(
+		unprotected,
+		reverseProxy.ServeHTTP,
+		AuditHandler(audit, AuthHandler(auth, whitelist, RateLimitHandler(limiter, ConcurrencyLimitHandler(concurrencyLimiter, reverseProxy.ServeHTTP)))),
+	))))))))
+	server := NewServer(serveAt, mux, serverOptions)
+	if certFile, keyFile := c.String("tls-cert-file"), c.String("tls-key-file"); certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return cli.Exit("tls-cert-file and tls-key-file must be set together", 1)
+		}
+		reloader, err := NewCertificateReloader(certFile, keyFile)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("could not load TLS certificate: %w", err), 1)
+		}
+		server.TLSConfig, err = NewTLSConfig(reloader, c.String("tls-min-version"), c.StringSlice("tls-cipher-suites"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		slog.Info("Serving with TLS", "cert_file", certFile, "key_file", keyFile, "min_version", c.String("tls-min-version"))
+	}
+	listener, err := net.Listen("tcp", serveAt)
+	if err != nil {
+		fatal("Prometheus multi tenant proxy can not start", "err", err)
+	}
+	if err := ServeUntilDone(ctx, server, listener, draining, c.Duration("shutdown-delay"), shutdownTimeout); err != nil {
+		slog.Error("Prometheus multi tenant proxy did not shut down gracefully", "err", err)
+		return cli.Exit(err, 1)
+	}
+	slog.Info("Prometheus multi tenant proxy stopped")
+	return nil
+}
 
-	http.HandleFunc("/", LogRequest(AuthHandler(auth, whitelist, reverseProxy.ServeHTTP)))
-	if err := http.ListenAndServe(serveAt, nil); err != nil {
-		log.Fatalf("Prometheus multi tenant proxy can not start %v", err)
-		return err
+func newAuth(authType, configLocation string) Auth {
+	switch authType {
+	case "basic":
+		return NewBasicAuth(configLocation)
+	case "jwt":
+		return NewJwtAuth(configLocation)
+	case "ldap":
+		return NewLDAPAuth(configLocation)
 	}
+	fatal("auth-type must be one of: basic, jwt, ldap", "auth_type", authType) // will exit
 	return nil
 }
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ServerOptions configures the timeouts and limits of an http.Server, zero values disable them
+type ServerOptions struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// MaxHeaderBytes is the maximum size of the request headers, http.DefaultMaxHeaderBytes if 0
+	MaxHeaderBytes int
+}
+
+// NewServer creates an http.Server serving handler at addr with the options
+func NewServer(addr string, handler http.Handler, options ServerOptions) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       options.ReadTimeout,
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		WriteTimeout:      options.WriteTimeout,
+		IdleTimeout:       options.IdleTimeout,
+		MaxHeaderBytes:    options.MaxHeaderBytes,
+	}
+}
+
+// DrainHandler can be used as a middleware chain to answer the readiness endpoint
+// with a 503 Service Unavailable response while the proxy shuts down
+func DrainHandler(draining *atomic.Bool, readiness *RouteMatcher, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() && readiness.Match(r.URL.Path) {
+			writeErrorResponse(w, http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// ServeUntilDone serves with the listener, using TLS if the server has a TLS configuration, until ctx is done, then shuts the server down:
+// draining is set, and after delay the server stops accepting connections and waits up to
+// timeout for the in-flight requests to complete
+func ServeUntilDone(ctx context.Context, server *http.Server, listener net.Listener, draining *atomic.Bool, delay, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ServeTLS(listener, "", "")
+			return
+		}
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	if draining != nil {
+		draining.Store(true)
+	}
+	if delay > 0 {
+		slog.Info("Shutting down, waiting before draining the requests", "delay", delay)
+		time.Sleep(delay)
+	}
+	slog.Info("Shutting down, draining the in-flight requests", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
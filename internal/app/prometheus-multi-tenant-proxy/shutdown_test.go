@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainHandler(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		draining bool
+		path     string
+		status   int
+	}{
+		{"ready", false, "/-/ready", http.StatusOK},
+		{"draining ready", true, "/-/ready", http.StatusServiceUnavailable},
+		{"draining query", true, "/api/v1/query", http.StatusOK},
+		{"draining healthy", true, "/-/healthy", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			draining := new(atomic.Bool)
+			draining.Store(tc.draining)
+			h := DrainHandler(draining, NewRouteMatcher("", []string{"/-/ready"}), func(w http.ResponseWriter, r *http.Request) {})
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest("GET", tc.path, nil))
+			if w.Code != tc.status {
+				t.Errorf("Got status %d, expected %d", w.Code, tc.status)
+			}
+		})
+	}
+}
+
+func TestServeUntilDone(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	draining := new(atomic.Bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", DrainHandler(draining, NewRouteMatcher("", []string{"/-/ready"}), func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+	server := NewServer(listener.Addr().String(), mux, ServerOptions{ReadHeaderTimeout: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeUntilDone(ctx, server, listener, draining, 200*time.Millisecond, 5*time.Second)
+	}()
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+	cancel()
+
+	// The readiness endpoint fails during the shutdown delay
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get(url + "/-/ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Readiness got status %d while draining", resp.StatusCode)
+	}
+
+	close(release)
+	if body := <-slow; body != "ok" {
+		t.Errorf("In flight request should complete, got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if _, err := http.Get(url + "/-/ready"); err == nil {
+		t.Error("Server should not accept connections once shut down")
+	}
+}
+
+func TestServeUntilDone_Timeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), ServerOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeUntilDone(ctx, server, listener, nil, 0, 100*time.Millisecond)
+	}()
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+	cancel()
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("Got %v, expected the shutdown to time out", err)
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions are the minimum TLS versions accepted by NewTLSConfig
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CertificateReloader serves a certificate and its key from files, reloaded
+// once they are modified, e.g. when cert-manager renews the certificate
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	lock     *sync.Mutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+// NewCertificateReloader creates a CertificateReloader, loading the certificate and its key
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		lock:     new(sync.Mutex),
+	}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate returns the certificate, after reloading it if the files were modified.
+// The previous certificate is kept if the new one cannot be loaded, e.g. while only one
+// of the files is renewed
+func (reloader *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+	if reloaded, err := reloader.reload(); err != nil {
+		slog.Error("Could not reload TLS certificate", "cert_file", reloader.certFile, "key_file", reloader.keyFile, "err", err)
+	} else if reloaded {
+		slog.Info("Reloaded TLS certificate", "cert_file", reloader.certFile, "key_file", reloader.keyFile)
+	}
+	return reloader.cert, nil
+}
+
+// reload loads the certificate if the files were modified since the last load, returning true if it did
+func (reloader *CertificateReloader) reload() (bool, error) {
+	certMod, keyMod, err := reloader.modTimes()
+	if err != nil {
+		return false, err
+	}
+	if reloader.cert != nil && certMod.Equal(reloader.certMod) && keyMod.Equal(reloader.keyMod) {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+	reloader.cert, reloader.certMod, reloader.keyMod = &cert, certMod, keyMod
+	return true, nil
+}
+
+func (reloader *CertificateReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// NewTLSConfig creates the TLS configuration serving the certificate of the reloader,
+// with the minimum TLS version (1.0, 1.1, 1.2 or 1.3) and the given cipher suites, by
+// their IANA name. The default cipher suites are used if none is given. The cipher
+// suites of TLS 1.3 are not configurable
+func NewTLSConfig(reloader *CertificateReloader, minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid minimum TLS version %q, must be one of: 1.0, 1.1, 1.2, 1.3", minVersion)
+	}
+	ids, err := cipherSuiteIDs(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   ids,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// cipherSuiteIDs returns the ids of the cipher suites, only the secure ones are accepted
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid or insecure TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for commonName and its key to dir
+func writeCertificate(t *testing.T, dir, commonName string, modTime time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReloader_GetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeCertificate(t, dir, "first", now.Add(-time.Minute))
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := reloader.GetCertificate(nil)
+	if name := commonName(t, cert); name != "first" {
+		t.Errorf("Got certificate %s, expected first", name)
+	}
+
+	writeCertificate(t, dir, "second", now)
+	cert, _ = reloader.GetCertificate(nil)
+	if name := commonName(t, cert); name != "second" {
+		t.Errorf("Renewed certificate should be reloaded, got %s", name)
+	}
+
+	// A certificate renewed without its key is not served
+	if err := os.WriteFile(certFile, []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	cert, err = reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, cert); name != "second" {
+		t.Errorf("Previous certificate should be kept, got %s", name)
+	}
+}
+
+func TestNewCertificateReloader_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _ := writeCertificate(t, dir, "proxy", time.Now())
+	if _, err := NewCertificateReloader(certFile, filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("Missing key should be an error")
+	}
+	if _, err := NewCertificateReloader(certFile, certFile); err == nil {
+		t.Error("Invalid key should be an error")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "proxy", time.Now())
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		desc         string
+		minVersion   string
+		cipherSuites []string
+		version      uint16
+		suites       []uint16
+		valid        bool
+	}{
+		{"defaults", "1.2", nil, tls.VersionTLS12, nil, true},
+		{"tls 1.3", "1.3", nil, tls.VersionTLS13, nil, true},
+		{"cipher suites", "1.2", []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, true},
+		{"invalid version", "1.4", nil, 0, nil, false},
+		{"unknown cipher suite", "1.2", []string{"TLS_FOO"}, 0, nil, false},
+		{"insecure cipher suite", "1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}, 0, nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			config, err := NewTLSConfig(reloader, tc.minVersion, tc.cipherSuites)
+			if (err == nil) != tc.valid {
+				t.Fatalf("Got error %v, expected valid %v", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+			if config.MinVersion != tc.version {
+				t.Errorf("Got version %x, expected %x", config.MinVersion, tc.version)
+			}
+			if len(config.CipherSuites) != len(tc.suites) {
+				t.Fatalf("Got cipher suites %v, expected %v", config.CipherSuites, tc.suites)
+			}
+			for i := range tc.suites {
+				if config.CipherSuites[i] != tc.suites[i] {
+					t.Errorf("Got cipher suites %v, expected %v", config.CipherSuites, tc.suites)
+				}
+			}
+		})
+	}
+}
+
+func TestServeUntilDone_TLS(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "proxy", time.Now())
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), ServerOptions{})
+	if server.TLSConfig, err = NewTLSConfig(reloader, "1.2", nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeUntilDone(ctx, server, listener, nil, 0, time.Second)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "proxy" {
+		t.Errorf("Request should be served with the certificate of the reloader")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+}
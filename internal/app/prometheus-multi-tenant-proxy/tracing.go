@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracerName is the instrumentation scope of the spans of the proxy
+	tracerName = "github.com/k8spin/prometheus-multi-tenant-proxy"
+	// serviceName identifies the proxy in the traces
+	serviceName = "prometheus-multi-tenant-proxy"
+)
+
+func init() {
+	// W3C trace context is propagated even if the spans are not exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// NewTracerProvider creates a TracerProvider exporting the spans to the OTLP/HTTP endpoint,
+// e.g. http://localhost:4318, keeping the given ratio of the traces not sampled by the caller
+func NewTracerProvider(ctx context.Context, endpoint string, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	), nil
+}
+
+// tracer returns the tracer of the global TracerProvider, a no-op unless tracing is enabled
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// TraceRequest can be used as a middleware chain to start the span of every request,
+// continuing the trace of the client if any
+func TraceRequest(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		endpoint := endpointLabel(r.URL.Path)
+		ctx, span := tracer().Start(ctx, r.Method+" "+endpoint,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", endpoint),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r.WithContext(ctx))
+
+		status := recorder.statusCode()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// traceIdentity adds the user and its scope to the span of the request
+func traceIdentity(ctx context.Context, identity *Identity) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("enduser.id", identity.Name),
+		attribute.StringSlice("tenant.namespaces", identity.Namespaces),
+	)
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTracerProvider(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defaultProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(defaultProvider) })
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing_Request(t *testing.T) {
+	recorder := newTestTracerProvider(t)
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	tripper := &ReversePrometheusRoundTripper{prometheusServerURL: upstreamURL}
+	reverseProxy := &httputil.ReverseProxy{Director: tripper.Director, Transport: tripper, ErrorHandler: tripper.ErrorHandler}
+
+	auth := &testAuth{authorized: true, namespaces: []string{"ns1"}}
+	handler := TraceRequest(AuthHandler(auth, nil, reverseProxy.ServeHTTP))
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	handler(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	names := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans {
+		names[span.Name()] = span
+		if span.SpanContext().TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("Span %s should continue the trace of the client", span.Name())
+		}
+	}
+	for _, name := range []string{"GET /api/v1/query", "auth", "rewrite", "upstream"} {
+		if _, ok := names[name]; !ok {
+			t.Fatalf("Span %s not found among %d spans", name, len(spans))
+		}
+	}
+
+	server := names["GET /api/v1/query"]
+	if spanAttribute(server, "enduser.id").AsString() != "test" || len(spanAttribute(server, "tenant.namespaces").AsStringSlice()) != 1 {
+		t.Errorf("Server span should have the user and tenant attributes: %v", server.Attributes())
+	}
+	if spanAttribute(server, "http.route").AsString() != "/api/v1/query" || spanAttribute(server, "http.response.status_code").AsInt64() != http.StatusOK {
+		t.Errorf("Server span should have the endpoint and status attributes: %v", server.Attributes())
+	}
+	if spanAttribute(names["auth"], "auth.result").AsString() != "success" {
+		t.Errorf("Auth span should have the auth result: %v", names["auth"].Attributes())
+	}
+	for _, name := range []string{"auth", "rewrite", "upstream"} {
+		if names[name].Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("Span %s should be a child of the server span", name)
+		}
+	}
+	if traceparent == "" || traceparent[3:35] != "0af7651916cd43dd8448eb211c80319c" || traceparent[36:52] != names["upstream"].SpanContext().SpanID().String() {
+		t.Errorf("Trace context not propagated to the upstream: %q", traceparent)
+	}
+}
+
+func TestTracing_Errors(t *testing.T) {
+	recorder := newTestTracerProvider(t)
+	tripper := &ReversePrometheusRoundTripper{prometheusServerURL: base}
+	reverseProxy := &httputil.ReverseProxy{Director: tripper.Director, Transport: tripper, ErrorHandler: tripper.ErrorHandler}
+
+	auth := &testAuth{authorized: false}
+	handler := TraceRequest(AuthHandler(auth, nil, reverseProxy.ServeHTTP))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	auth.authorized, auth.namespaces = true, []string{"ns1"}
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up{", nil))
+
+	errors := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		errors[span.Name()] = errors[span.Name()] || span.Status().Code == codes.Error
+	}
+	if !errors["auth"] || !errors["rewrite"] {
+		t.Errorf("Denied requests and rejected queries should be recorded as errors: %v", errors)
+	}
+}
+
+func TestTracing_NewTracerProvider(t *testing.T) {
+	provider, err := NewTracerProvider(context.Background(), "http://127.0.0.1:1", 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown without spans should not export: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// UpstreamOptions configures the connections to Prometheus, zero values keep the defaults of http.DefaultTransport
+type UpstreamOptions struct {
+	// CAFile is the path of the CA bundle verifying the certificate of Prometheus, the system roots if empty
+	CAFile string
+	// CertFile and KeyFile are the paths of the client certificate and its key, reloaded when modified
+	CertFile string
+	KeyFile  string
+	// ServerName is the name verified in the certificate of Prometheus, the host of its URL if empty
+	ServerName string
+	// InsecureSkipVerify disables the verification of the certificate of Prometheus
+	InsecureSkipVerify bool
+
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// NewUpstreamTransport creates the transport of the requests to Prometheus
+func NewUpstreamTransport(options UpstreamOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.MaxIdleConns > 0 {
+		transport.MaxIdleConns = options.MaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = options.MaxConnsPerHost
+	if options.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+	if options.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: options.DialTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	if options.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+
+	config, err := newUpstreamTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+func newUpstreamTLSConfig(options UpstreamOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read upstream CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in upstream CA file %s", options.CAFile)
+		}
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, fmt.Errorf("the upstream client certificate and key must be set together")
+		}
+		reloader, err := NewCertificateReloader(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load upstream client certificate: %w", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.GetCertificate(nil)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamTransport_TLS(t *testing.T) {
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	serverCert, serverKey := writeCertificate(t, serverDir, "prometheus", time.Now())
+	clientCert, clientKey := writeCertificate(t, clientDir, "proxy", time.Now())
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA, _ := os.ReadFile(clientCert)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCA)
+	var clientCN string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCN = ""
+		if len(r.TLS.PeerCertificates) > 0 {
+			clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientCAs,
+	}
+	// The failed handshakes are expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	testCases := []struct {
+		desc     string
+		options  UpstreamOptions
+		ok       bool
+		clientCN string
+	}{
+		{"unknown CA", UpstreamOptions{}, false, ""},
+		{"CA without server name", UpstreamOptions{CAFile: serverCert}, false, ""},
+		{"CA and server name", UpstreamOptions{CAFile: serverCert, ServerName: "prometheus"}, true, ""},
+		{"wrong server name", UpstreamOptions{CAFile: serverCert, ServerName: "other"}, false, ""},
+		{"insecure", UpstreamOptions{InsecureSkipVerify: true}, true, ""},
+		{"client certificate", UpstreamOptions{CAFile: serverCert, ServerName: "prometheus", CertFile: clientCert, KeyFile: clientKey}, true, "proxy"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			transport, err := NewUpstreamTransport(tc.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			resp, err := transport.RoundTrip(req)
+			if (err == nil) != tc.ok {
+				t.Fatalf("Got error %v, expected success %v", err, tc.ok)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if clientCN != tc.clientCN {
+				t.Errorf("Got client certificate %q, expected %q", clientCN, tc.clientCN)
+			}
+		})
+	}
+}
+
+func TestNewUpstreamTransport_Options(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "proxy", time.Now())
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte(""), 0o600)
+
+	testCases := []struct {
+		desc    string
+		options UpstreamOptions
+		valid   bool
+	}{
+		{"defaults", UpstreamOptions{}, true},
+		{"missing CA file", UpstreamOptions{CAFile: filepath.Join(dir, "missing.pem")}, false},
+		{"empty CA file", UpstreamOptions{CAFile: empty}, false},
+		{"certificate without key", UpstreamOptions{CertFile: certFile}, false},
+		{"key without certificate", UpstreamOptions{KeyFile: keyFile}, false},
+		{"invalid key", UpstreamOptions{CertFile: certFile, KeyFile: certFile}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := NewUpstreamTransport(tc.options); (err == nil) != tc.valid {
+				t.Errorf("Got error %v, expected valid %v", err, tc.valid)
+			}
+		})
+	}
+
+	transport, err := NewUpstreamTransport(UpstreamOptions{
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   5,
+		MaxConnsPerHost:       20,
+		IdleConnTimeout:       time.Minute,
+		TLSHandshakeTimeout:   time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 5 || transport.MaxConnsPerHost != 20 ||
+		transport.IdleConnTimeout != time.Minute || transport.TLSHandshakeTimeout != time.Second ||
+		transport.ResponseHeaderTimeout != 2*time.Minute {
+		t.Errorf("Options not applied: %+v", transport)
+	}
+	if transport.Proxy == nil {
+		t.Error("The proxy environment variables should still be used")
+	}
+}
@@ -1,14 +1,16 @@
 package pkg
 
 import (
+	"fmt"
 	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
-// Authn Contains a list of users
+// Authn Contains a list of users and the groups they can belong to
 type Authn struct {
-	Users []User `yaml:"users"`
+	Groups []Group `yaml:"groups"`
+	Users  []User  `yaml:"users"`
 }
 
 // User Identifies a user including the tenant
@@ -18,6 +20,28 @@ type User struct {
 	Namespace  string              `yaml:"namespace"`
 	Namespaces []string            `yaml:"namespaces"`
 	Labels     map[string][]string `yaml:"labels"`
+	Groups     []string            `yaml:"groups"`
+	// ExcludedNamespaces and ExcludedLabels hide series, even within the namespaces and labels above
+	ExcludedNamespaces []string            `yaml:"excludedNamespaces"`
+	ExcludedLabels     map[string][]string `yaml:"excludedLabels"`
+	// Endpoints restrict the protected endpoints for the user, and Methods restrict the HTTP methods
+	Endpoints []string `yaml:"endpoints"`
+	Methods   []string `yaml:"methods"`
+	// RateLimit limits the requests of the user, the most permissive limit of its groups if not set
+	RateLimit *RateLimit `yaml:"rateLimit"`
+	// QueryLimits restricts the queries of the user, the most permissive limits of its groups if not set
+	QueryLimits *QueryLimits `yaml:"queryLimits"`
+}
+
+// Group Grants namespaces and labels to its members
+type Group struct {
+	Name               string              `yaml:"name"`
+	Namespaces         []string            `yaml:"namespaces"`
+	Labels             map[string][]string `yaml:"labels"`
+	ExcludedNamespaces []string            `yaml:"excludedNamespaces"`
+	ExcludedLabels     map[string][]string `yaml:"excludedLabels"`
+	RateLimit          *RateLimit          `yaml:"rateLimit"`
+	QueryLimits        *QueryLimits        `yaml:"queryLimits"`
 }
 
 // ParseConfig read a configuration file in the path `location` and returns an Authn object
@@ -34,6 +58,17 @@ func ParseConfig(location *string) (*Authn, error) {
 		return nil, err
 	}
 
+	for _, group := range authn.Groups {
+		if err := ValidateScope(group.Namespaces, group.Labels, group.ExcludedNamespaces, group.ExcludedLabels); err != nil {
+			return nil, fmt.Errorf("group %s: %w", group.Name, err)
+		}
+		if err := group.RateLimit.Validate(); err != nil {
+			return nil, fmt.Errorf("group %s: %w", group.Name, err)
+		}
+		if err := group.QueryLimits.Validate(); err != nil {
+			return nil, fmt.Errorf("group %s: %w", group.Name, err)
+		}
+	}
 	for i := range authn.Users {
 		if authn.Users[i].Namespaces == nil {
 			authn.Users[i].Namespaces = []string{}
@@ -41,6 +76,76 @@ func ParseConfig(location *string) (*Authn, error) {
 		if authn.Users[i].Labels == nil {
 			authn.Users[i].Labels = map[string][]string{}
 		}
+		user := &authn.Users[i]
+		if err := ValidatePatterns(user.Namespace); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if err := ValidateScope(user.Namespaces, user.Labels, user.ExcludedNamespaces, user.ExcludedLabels); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if err := user.RateLimit.Validate(); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if err := user.QueryLimits.Validate(); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if err := user.inheritGroups(authn.Groups); err != nil {
+			return nil, err
+		}
 	}
 	return &authn, nil
 }
+
+// inheritGroups adds the namespaces and labels of the groups of the user to its own
+func (user *User) inheritGroups(groups []Group) error {
+	var rateLimit *RateLimit
+	var queryLimits []*QueryLimits
+	for _, name := range user.Groups {
+		group := findGroup(groups, name)
+		if group == nil {
+			return fmt.Errorf("user %s: unknown group %s", user.Username, name)
+		}
+		user.Namespaces = appendUnique(user.Namespaces, group.Namespaces...)
+		for k, v := range group.Labels {
+			user.Labels[k] = appendUnique(user.Labels[k], v...)
+		}
+		user.ExcludedNamespaces = appendUnique(user.ExcludedNamespaces, group.ExcludedNamespaces...)
+		for k, v := range group.ExcludedLabels {
+			if user.ExcludedLabels == nil {
+				user.ExcludedLabels = map[string][]string{}
+			}
+			user.ExcludedLabels[k] = appendUnique(user.ExcludedLabels[k], v...)
+		}
+		rateLimit = MaxRateLimit(rateLimit, group.RateLimit)
+		queryLimits = append(queryLimits, group.QueryLimits)
+	}
+	if user.RateLimit == nil {
+		user.RateLimit = rateLimit
+	}
+	if user.QueryLimits == nil {
+		user.QueryLimits = MergeQueryLimits(queryLimits...)
+	}
+	return nil
+}
+
+func findGroup(groups []Group, name string) *Group {
+	for i := range groups {
+		if groups[i].Name == name {
+			return &groups[i]
+		}
+	}
+	return nil
+}
+
+func appendUnique(values []string, elems ...string) []string {
+	for _, elem := range elems {
+		found := false
+		for _, v := range values {
+			found = found || v == elem
+		}
+		if !found {
+			values = append(values, elem)
+		}
+	}
+	return values
+}
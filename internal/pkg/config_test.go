@@ -3,6 +3,9 @@ package pkg
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -12,9 +15,17 @@ func TestParseConfig(t *testing.T) {
 	configMultipleUserLocation := "../../configs/multiple.user.yaml"
 	configMultipleNamespacesLocation := "../../configs/multiple.namespaces.yaml"
 	configSampleLabelsLocation := "../../configs/sample.labels.yaml"
+	configGroupsLocation := "../../configs/groups.yaml"
+	configUnknownGroupLocation := "../../configs/bad.groups.yaml"
+	configSampleExcludedLocation := "../../configs/sample.excluded.yaml"
+	configInvalidPatternLocation := "../../configs/bad.pattern.yaml"
+	configSampleEndpointsLocation := "../../configs/sample.endpoints.yaml"
+	configSampleRateLimitLocation := "../../configs/sample.ratelimit.yaml"
+	configInvalidRateLimitLocation := "../../configs/bad.ratelimit.yaml"
+	configSampleQueryLimitsLocation := "../../configs/sample.querylimits.yaml"
 
 	expectedSampleAuth := Authn{
-		[]User{
+		Users: []User{
 			{
 				Username:   "Happy",
 				Password:   "Prometheus",
@@ -31,7 +42,7 @@ func TestParseConfig(t *testing.T) {
 		},
 	}
 	expectedSampleLabelsAuth := Authn{
-		[]User{
+		Users: []User{
 			{
 				Username:  "Happy",
 				Password:  "Prometheus",
@@ -64,7 +75,7 @@ func TestParseConfig(t *testing.T) {
 		},
 	}
 	expectedMultipleUserAuth := Authn{
-		[]User{
+		Users: []User{
 			{
 				Username:   "User-a",
 				Password:   "pass-a",
@@ -82,7 +93,7 @@ func TestParseConfig(t *testing.T) {
 		},
 	}
 	expectedMultipleNamespaceAuth := Authn{
-		[]User{
+		Users: []User{
 			{
 				Username:   "Happy",
 				Password:   "Prometheus",
@@ -121,6 +132,158 @@ func TestParseConfig(t *testing.T) {
 			},
 		},
 	}
+	groupA := Group{
+		Name:       "team-a",
+		Namespaces: []string{"tenant-a", "shared"},
+		Labels:     map[string][]string{"team": {"a"}},
+	}
+	groupB := Group{
+		Name:       "team-b",
+		Namespaces: []string{"tenant-b", "shared"},
+	}
+	expectedGroupsAuth := Authn{
+		Groups: []Group{groupA, groupB},
+		Users: []User{
+			{
+				Username:   "Happy",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a", "shared"},
+				Labels:     map[string][]string{"team": {"a"}},
+				Groups:     []string{"team-a"},
+			}, {
+				Username:   "Sad",
+				Password:   "Prometheus",
+				Namespaces: []string{"kube-system", "tenant-a", "shared", "tenant-b"},
+				Labels:     map[string][]string{"team": {"sre", "a"}},
+				Groups:     []string{"team-a", "team-b"},
+			},
+		},
+	}
+	expectedSampleExcludedAuth := Authn{
+		Groups: []Group{
+			{
+				Name:           "no-sensitive",
+				ExcludedLabels: map[string][]string{"sensitive": {"true"}},
+			},
+		},
+		Users: []User{
+			{
+				Username:           "Happy",
+				Password:           "Prometheus",
+				Namespaces:         []string{},
+				Labels:             map[string][]string{},
+				Groups:             []string{"no-sensitive"},
+				ExcludedNamespaces: []string{"kube-system", "monitoring"},
+				ExcludedLabels:     map[string][]string{"sensitive": {"true"}},
+			},
+		},
+	}
+	expectedSampleEndpointsAuth := Authn{
+		Users: []User{
+			{
+				Username:   "grafana",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a"},
+				Labels:     map[string][]string{},
+				Endpoints:  []string{"/api/v1/query", "/api/v1/query_range"},
+				Methods:    []string{"GET", "POST"},
+			}, {
+				Username:   "explorer",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a"},
+				Labels:     map[string][]string{},
+				Endpoints:  []string{"/api/v1/series"},
+				Methods:    []string{"GET"},
+			},
+		},
+	}
+	dashboardsLimit := &RateLimit{Rate: 5, Burst: 20}
+	batchLimit := &RateLimit{Rate: 1}
+	expectedSampleRateLimitAuth := Authn{
+		Groups: []Group{
+			{Name: "dashboards", Namespaces: []string{"tenant-a"}, RateLimit: dashboardsLimit},
+			{Name: "batch", Namespaces: []string{"tenant-b"}, RateLimit: batchLimit},
+		},
+		Users: []User{
+			{
+				Username:   "grafana",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a", "tenant-b"},
+				Labels:     map[string][]string{},
+				Groups:     []string{"dashboards", "batch"},
+				RateLimit:  dashboardsLimit,
+			}, {
+				Username:   "script",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a"},
+				Labels:     map[string][]string{},
+				Groups:     []string{"dashboards"},
+				RateLimit:  &RateLimit{Rate: 0.5, PerEndpoint: true},
+			}, {
+				Username:   "admin",
+				Password:   "Prometheus",
+				Namespace:  "monitoring",
+				Namespaces: []string{},
+				Labels:     map[string][]string{},
+			},
+		},
+	}
+	dashboardsQueryLimits := &QueryLimits{
+		MinStep:          model.Duration(15 * time.Second),
+		MaxPoints:        11000,
+		MaxRangeSelector: model.Duration(24 * time.Hour),
+		DeniedMetrics:    []string{"~etcd_.*"},
+		DeniedFunctions:  []string{"count_values"},
+	}
+	reportsQueryLimits := &QueryLimits{
+		MinStep:            model.Duration(time.Minute),
+		MaxRangeSelector:   model.Duration(7 * 24 * time.Hour),
+		RequireMetricName:  true,
+		MaxLookback:        model.Duration(30 * 24 * time.Hour),
+		DeniedMetrics:      []string{"~etcd_.*", "~apiserver_.*"},
+		StripDeniedMetrics: true,
+	}
+	expectedSampleQueryLimitsAuth := Authn{
+		Groups: []Group{
+			{Name: "dashboards", Namespaces: []string{"tenant-a"}, QueryLimits: dashboardsQueryLimits},
+			{Name: "reports", Namespaces: []string{"tenant-a"}, QueryLimits: reportsQueryLimits},
+			{Name: "admins", Namespaces: []string{"tenant-b"}},
+		},
+		Users: []User{
+			{
+				Username:   "grafana",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a"},
+				Labels:     map[string][]string{},
+				Groups:     []string{"dashboards", "reports"},
+				QueryLimits: &QueryLimits{
+					MinStep:            model.Duration(15 * time.Second),
+					MaxRangeSelector:   model.Duration(7 * 24 * time.Hour),
+					DeniedMetrics:      []string{"~etcd_.*"},
+					StripDeniedMetrics: true,
+				},
+			}, {
+				Username:   "script",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a"},
+				Labels:     map[string][]string{},
+				Groups:     []string{"dashboards"},
+				QueryLimits: &QueryLimits{
+					MinStep:           model.Duration(5 * time.Minute),
+					RequireMetricName: true,
+					MaxLookback:       model.Duration(7 * 24 * time.Hour),
+					MaxTimeRange:      model.Duration(24 * time.Hour),
+					ClampTimeRange:    true,
+				},
+			}, {
+				Username:   "admin",
+				Password:   "Prometheus",
+				Namespaces: []string{"tenant-a", "tenant-b"},
+				Labels:     map[string][]string{},
+				Groups:     []string{"dashboards", "admins"},
+			},
+		},
+	}
 	type args struct {
 		location *string
 	}
@@ -158,6 +321,62 @@ func TestParseConfig(t *testing.T) {
 			},
 			&expectedMultipleNamespaceAuth,
 			false,
+		}, {
+			"Groups",
+			args{
+				&configGroupsLocation,
+			},
+			&expectedGroupsAuth,
+			false,
+		}, {
+			"Excluded namespaces and labels",
+			args{
+				&configSampleExcludedLocation,
+			},
+			&expectedSampleExcludedAuth,
+			false,
+		}, {
+			"Endpoints and methods",
+			args{
+				&configSampleEndpointsLocation,
+			},
+			&expectedSampleEndpointsAuth,
+			false,
+		}, {
+			"Rate limits",
+			args{
+				&configSampleRateLimitLocation,
+			},
+			&expectedSampleRateLimitAuth,
+			false,
+		}, {
+			"Invalid rate limit",
+			args{
+				&configInvalidRateLimitLocation,
+			},
+			nil,
+			true,
+		}, {
+			"Query limits",
+			args{
+				&configSampleQueryLimitsLocation,
+			},
+			&expectedSampleQueryLimitsAuth,
+			false,
+		}, {
+			"Invalid pattern",
+			args{
+				&configInvalidPatternLocation,
+			},
+			nil,
+			true,
+		}, {
+			"Unknown group",
+			args{
+				&configUnknownGroupLocation,
+			},
+			nil,
+			true,
 		}, {
 			"Invalid location",
 			args{
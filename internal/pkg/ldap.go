@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultLDAPUserFilter     = "(uid=%s)"
+	defaultLDAPGroupFilter    = "(member=%s)"
+	defaultLDAPGroupAttribute = "cn"
+	defaultLDAPCacheTTL       = time.Minute
+)
+
+// LDAPConfig Describes how to authenticate users against an LDAP server
+// and how their groups map to namespaces and labels
+type LDAPConfig struct {
+	URL                string        `yaml:"url"`
+	StartTLS           bool          `yaml:"startTLS"`
+	InsecureSkipVerify bool          `yaml:"insecureSkipVerify"`
+	BindDN             string        `yaml:"bindDN"`
+	BindPassword       string        `yaml:"bindPassword"`
+	UserSearch         LDAPSearch    `yaml:"userSearch"`
+	GroupSearch        LDAPSearch    `yaml:"groupSearch"`
+	CacheTTL           time.Duration `yaml:"cacheTTL"`
+	Groups             []Group       `yaml:"groups"`
+}
+
+// LDAPSearch Identifies LDAP entries. The `%s` in Filter is replaced by
+// the username (user search) or the user DN (group search)
+type LDAPSearch struct {
+	BaseDN    string `yaml:"baseDN"`
+	Filter    string `yaml:"filter"`
+	Attribute string `yaml:"attribute"`
+}
+
+// ParseLDAPConfig read a configuration file in the path `location` and returns an LDAPConfig object
+func ParseLDAPConfig(location *string) (*LDAPConfig, error) {
+	file, err := os.Open(*location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := LDAPConfig{}
+	err = yaml.NewDecoder(file).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.URL == "" {
+		return nil, errors.New("ldap: url is required")
+	}
+	if config.UserSearch.BaseDN == "" {
+		return nil, errors.New("ldap: userSearch.baseDN is required")
+	}
+	if config.UserSearch.Filter == "" {
+		config.UserSearch.Filter = defaultLDAPUserFilter
+	}
+	if config.GroupSearch.BaseDN == "" {
+		config.GroupSearch.BaseDN = config.UserSearch.BaseDN
+	}
+	if config.GroupSearch.Filter == "" {
+		config.GroupSearch.Filter = defaultLDAPGroupFilter
+	}
+	if config.GroupSearch.Attribute == "" {
+		config.GroupSearch.Attribute = defaultLDAPGroupAttribute
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = defaultLDAPCacheTTL
+	}
+	for i := range config.Groups {
+		group := &config.Groups[i]
+		if err := ValidateScope(group.Namespaces, group.Labels, group.ExcludedNamespaces, group.ExcludedLabels); err != nil {
+			return nil, fmt.Errorf("ldap: group %s: %w", group.Name, err)
+		}
+		if err := group.RateLimit.Validate(); err != nil {
+			return nil, fmt.Errorf("ldap: group %s: %w", group.Name, err)
+		}
+		if err := group.QueryLimits.Validate(); err != nil {
+			return nil, fmt.Errorf("ldap: group %s: %w", group.Name, err)
+		}
+		if config.Groups[i].Namespaces == nil {
+			config.Groups[i].Namespaces = []string{}
+		}
+		if config.Groups[i].Labels == nil {
+			config.Groups[i].Labels = map[string][]string{}
+		}
+	}
+	return &config, nil
+}
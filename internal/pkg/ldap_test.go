@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLDAPConfig(t *testing.T) {
+	configInvalidLocation := "../../configs/no.config.yaml"
+	configMissingSearchLocation := "../../configs/bad.ldap.yaml"
+	configLDAPLocation := "../../configs/ldap.yaml"
+
+	expectedLDAPConfig := LDAPConfig{
+		URL:          "ldaps://ldap.example.com:636",
+		BindDN:       "cn=prometheus-proxy,ou=services,dc=example,dc=com",
+		BindPassword: "secret",
+		UserSearch: LDAPSearch{
+			BaseDN: "ou=people,dc=example,dc=com",
+			Filter: "(uid=%s)",
+		},
+		GroupSearch: LDAPSearch{
+			BaseDN:    "ou=groups,dc=example,dc=com",
+			Filter:    "(member=%s)",
+			Attribute: "cn",
+		},
+		CacheTTL: 30 * time.Second,
+		Groups: []Group{
+			{
+				Name:       "team-a",
+				Namespaces: []string{"tenant-a"},
+				Labels:     map[string][]string{},
+			}, {
+				Name:       "team-b",
+				Namespaces: []string{"tenant-b"},
+				Labels: map[string][]string{
+					"app": {"shop"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		location *string
+		want     *LDAPConfig
+		wantErr  bool
+	}{
+		{"LDAP", &configLDAPLocation, &expectedLDAPConfig, false},
+		{"Missing user search", &configMissingSearchLocation, nil, true},
+		{"Invalid location", &configInvalidLocation, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLDAPConfig(tt.location)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseLDAPConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLDAPConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
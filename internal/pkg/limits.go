@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/prometheus/common/model"
+)
+
+// RateLimit Limits the requests of a user with a token bucket
+type RateLimit struct {
+	// Rate is the number of requests allowed per second
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of requests allowed at once, Rate rounded up if zero
+	Burst int `yaml:"burst"`
+	// PerEndpoint applies the limit to every endpoint separately
+	PerEndpoint bool `yaml:"perEndpoint"`
+}
+
+// Validate returns an error if the rate limit is not valid
+func (limit *RateLimit) Validate() error {
+	if limit == nil {
+		return nil
+	}
+	if limit.Rate <= 0 {
+		return errors.New("rateLimit: rate must be positive")
+	}
+	if limit.Burst < 0 {
+		return errors.New("rateLimit: burst must not be negative")
+	}
+	return nil
+}
+
+// GetBurst returns the burst of the rate limit, defaulting to its rate rounded up
+func (limit *RateLimit) GetBurst() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return int(math.Ceil(limit.Rate))
+}
+
+// MaxRateLimit returns the most permissive of the rate limits, ignoring nil ones
+func MaxRateLimit(limits ...*RateLimit) *RateLimit {
+	var max *RateLimit
+	for _, limit := range limits {
+		if limit == nil {
+			continue
+		}
+		if max == nil || limit.Rate > max.Rate || (limit.Rate == max.Rate && limit.GetBurst() > max.GetBurst()) {
+			max = limit
+		}
+	}
+	return max
+}
+
+// QueryLimits Restricts the cost of the queries of a user. Zero values are unlimited.
+type QueryLimits struct {
+	// MinStep is the smallest step allowed for range queries
+	MinStep model.Duration `yaml:"minStep"`
+	// MaxPoints is the largest number of points per series allowed for range queries: (end - start) / step
+	MaxPoints int `yaml:"maxPoints"`
+	// MaxRangeSelector is the longest range allowed in range selectors and subqueries, e.g. [5m]
+	MaxRangeSelector model.Duration `yaml:"maxRangeSelector"`
+	// RequireMetricName rejects the selectors without metric name, e.g. {namespace="a"}
+	RequireMetricName bool `yaml:"requireMetricName"`
+	// MaxLookback is how far back from now the queried time range may start
+	MaxLookback model.Duration `yaml:"maxLookback"`
+	// MaxTimeRange is the longest time range allowed between start and end
+	MaxTimeRange model.Duration `yaml:"maxTimeRange"`
+	// ClampTimeRange restricts the queried time range to the limits instead of rejecting the query
+	ClampTimeRange bool `yaml:"clampTimeRange"`
+	// DeniedMetrics are the names or patterns of the metrics the user cannot query
+	DeniedMetrics []string `yaml:"deniedMetrics"`
+	// DeniedFunctions are the PromQL functions and aggregations the user cannot use
+	DeniedFunctions []string `yaml:"deniedFunctions"`
+	// StripDeniedMetrics turns the selectors of denied metrics into selectors matching no series instead of rejecting the query
+	StripDeniedMetrics bool `yaml:"stripDeniedMetrics"`
+}
+
+// Validate returns an error if the query limits are not valid
+func (limits *QueryLimits) Validate() error {
+	if limits == nil {
+		return nil
+	}
+	if limits.MinStep < 0 || limits.MaxRangeSelector < 0 || limits.MaxLookback < 0 || limits.MaxTimeRange < 0 {
+		return errors.New("queryLimits: durations must not be negative")
+	}
+	if limits.MaxPoints < 0 {
+		return errors.New("queryLimits: maxPoints must not be negative")
+	}
+	if err := ValidatePatterns(limits.DeniedMetrics...); err != nil {
+		return fmt.Errorf("queryLimits: deniedMetrics: %w", err)
+	}
+	return nil
+}
+
+// MergeQueryLimits returns the most permissive of every limit. Nil query limits are
+// unlimited, so the merged limits are nil if any of them is nil or if there are none
+func MergeQueryLimits(limits ...*QueryLimits) *QueryLimits {
+	var merged *QueryLimits
+	for _, l := range limits {
+		if l == nil {
+			return nil
+		}
+		if merged == nil {
+			copied := *l
+			merged = &copied
+			continue
+		}
+		merged.MinStep = min(merged.MinStep, l.MinStep)
+		merged.MaxPoints = maxLimit(merged.MaxPoints, l.MaxPoints)
+		merged.MaxRangeSelector = maxLimit(merged.MaxRangeSelector, l.MaxRangeSelector)
+		merged.RequireMetricName = merged.RequireMetricName && l.RequireMetricName
+		merged.MaxLookback = maxLimit(merged.MaxLookback, l.MaxLookback)
+		merged.MaxTimeRange = maxLimit(merged.MaxTimeRange, l.MaxTimeRange)
+		merged.ClampTimeRange = merged.ClampTimeRange || l.ClampTimeRange
+		merged.DeniedMetrics = intersect(merged.DeniedMetrics, l.DeniedMetrics)
+		merged.DeniedFunctions = intersect(merged.DeniedFunctions, l.DeniedFunctions)
+		merged.StripDeniedMetrics = merged.StripDeniedMetrics || l.StripDeniedMetrics
+	}
+	return merged
+}
+
+// maxLimit returns the largest limit, zero being unlimited
+func maxLimit[T int | model.Duration](a, b T) T {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// intersect returns the values found in both a and b
+func intersect(a, b []string) []string {
+	var values []string
+	for _, v := range a {
+		if slices.Contains(b, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
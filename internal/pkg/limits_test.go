@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestRateLimit_Validate(t *testing.T) {
+	testCases := []struct {
+		limit *RateLimit
+		ok    bool
+	}{
+		{nil, true},
+		{&RateLimit{Rate: 1}, true},
+		{&RateLimit{Rate: 0.5, Burst: 2}, true},
+		{&RateLimit{Rate: 0}, false},
+		{&RateLimit{Rate: -1}, false},
+		{&RateLimit{Rate: 1, Burst: -1}, false},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.limit.Validate(); (err == nil) != tc.ok {
+			t.Errorf("Validate(%+v) = %v, expected ok=%v", tc.limit, err, tc.ok)
+		}
+	}
+}
+
+func TestRateLimit_GetBurst(t *testing.T) {
+	testCases := []struct {
+		limit    RateLimit
+		expected int
+	}{
+		{RateLimit{Rate: 10}, 10},
+		{RateLimit{Rate: 0.5}, 1},
+		{RateLimit{Rate: 2.5}, 3},
+		{RateLimit{Rate: 1, Burst: 5}, 5},
+	}
+
+	for _, tc := range testCases {
+		if burst := tc.limit.GetBurst(); burst != tc.expected {
+			t.Errorf("GetBurst(%+v) = %d, expected %d", tc.limit, burst, tc.expected)
+		}
+	}
+}
+
+func TestRateLimit_MaxRateLimit(t *testing.T) {
+	slow := &RateLimit{Rate: 1}
+	fast := &RateLimit{Rate: 10}
+	bursty := &RateLimit{Rate: 10, Burst: 50}
+
+	testCases := []struct {
+		desc     string
+		limits   []*RateLimit
+		expected *RateLimit
+	}{
+		{"none", nil, nil},
+		{"only nil", []*RateLimit{nil, nil}, nil},
+		{"single", []*RateLimit{nil, slow}, slow},
+		{"highest rate", []*RateLimit{slow, fast}, fast},
+		{"highest burst", []*RateLimit{fast, bursty, slow}, bursty},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if max := MaxRateLimit(tc.limits...); max != tc.expected {
+				t.Errorf("Got %+v, expected %+v", max, tc.expected)
+			}
+		})
+	}
+}
+
+func TestQueryLimits_Validate(t *testing.T) {
+	testCases := []struct {
+		limits *QueryLimits
+		ok     bool
+	}{
+		{nil, true},
+		{&QueryLimits{}, true},
+		{&QueryLimits{MinStep: model.Duration(time.Minute), MaxPoints: 100}, true},
+		{&QueryLimits{MinStep: -1}, false},
+		{&QueryLimits{MaxRangeSelector: -1}, false},
+		{&QueryLimits{MaxPoints: -1}, false},
+		{&QueryLimits{MaxLookback: -1}, false},
+		{&QueryLimits{MaxTimeRange: -1}, false},
+		{&QueryLimits{DeniedMetrics: []string{"etcd_db_total_size_in_bytes", "~apiserver_.*"}}, true},
+		{&QueryLimits{DeniedMetrics: []string{"~apiserver_(.*"}}, false},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.limits.Validate(); (err == nil) != tc.ok {
+			t.Errorf("Validate(%+v) = %v, expected ok=%v", tc.limits, err, tc.ok)
+		}
+	}
+}
+
+func TestQueryLimits_MergeQueryLimits(t *testing.T) {
+	strict := &QueryLimits{
+		MinStep:           model.Duration(time.Minute),
+		MaxPoints:         100,
+		MaxRangeSelector:  model.Duration(time.Hour),
+		RequireMetricName: true,
+		MaxLookback:       model.Duration(24 * time.Hour),
+		MaxTimeRange:      model.Duration(time.Hour),
+		DeniedMetrics:     []string{"~apiserver_.*", "~etcd_.*"},
+		DeniedFunctions:   []string{"count_values"},
+	}
+	loose := &QueryLimits{
+		MinStep:          model.Duration(time.Second),
+		MaxPoints:        1000,
+		MaxRangeSelector: model.Duration(24 * time.Hour),
+		MaxLookback:      model.Duration(7 * 24 * time.Hour),
+		MaxTimeRange:     model.Duration(24 * time.Hour),
+		ClampTimeRange:   true,
+		DeniedMetrics:    []string{"~etcd_.*"},
+	}
+	unlimited := &QueryLimits{}
+
+	testCases := []struct {
+		desc     string
+		limits   []*QueryLimits
+		expected *QueryLimits
+	}{
+		{"none", nil, nil},
+		{"only nil", []*QueryLimits{nil}, nil},
+		{"single", []*QueryLimits{strict}, strict},
+		{"nil is unlimited", []*QueryLimits{strict, nil}, nil},
+		{"nil first is unlimited", []*QueryLimits{nil, strict, loose}, nil},
+		{"most permissive", []*QueryLimits{strict, loose}, loose},
+		{"unlimited", []*QueryLimits{strict, unlimited}, unlimited},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if merged := MergeQueryLimits(tc.limits...); !reflect.DeepEqual(merged, tc.expected) {
+				t.Errorf("Got %+v, expected %+v", merged, tc.expected)
+			}
+		})
+	}
+
+	MergeQueryLimits(strict, loose)
+	if strict.MaxPoints != 100 {
+		t.Errorf("Merged limits should not be modified")
+	}
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PatternPrefix marks a namespace or label value as a regular expression.
+// Values without this prefix are literal values.
+const PatternPrefix = "~"
+
+// IsPattern returns true if the value is a regular expression
+func IsPattern(value string) bool {
+	return strings.HasPrefix(value, PatternPrefix)
+}
+
+// ToRegexp returns the regular expression matching the value: the pattern
+// itself for regular expressions, the escaped value for literal values
+func ToRegexp(value string) string {
+	if IsPattern(value) {
+		return strings.TrimPrefix(value, PatternPrefix)
+	}
+	return regexp.QuoteMeta(value)
+}
+
+// JoinRegexps returns the regular expression matching any of the values. The patterns
+// are grouped, so that their flags do not apply to the other values
+func JoinRegexps(values ...string) string {
+	if len(values) == 1 {
+		return ToRegexp(values[0])
+	}
+	regexps := make([]string, 0, len(values))
+	for _, value := range values {
+		if IsPattern(value) {
+			regexps = append(regexps, "(?:"+ToRegexp(value)+")")
+		} else {
+			regexps = append(regexps, ToRegexp(value))
+		}
+	}
+	return strings.Join(regexps, "|")
+}
+
+// ValidatePatterns checks that the regular expressions among the values compile,
+// alone and joined together as they are matched
+func ValidatePatterns(values ...string) error {
+	for _, value := range values {
+		if !IsPattern(value) {
+			continue
+		}
+		if _, err := regexp.Compile("^(?:" + ToRegexp(value) + ")$"); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", value, err)
+		}
+	}
+	if _, err := regexp.Compile("^(?:" + JoinRegexps(values...) + ")$"); err != nil {
+		return fmt.Errorf("invalid patterns %q: %w", values, err)
+	}
+	return nil
+}
+
+// ValidateScope checks the patterns of namespaces and labels, including the excluded ones
+func ValidateScope(namespaces []string, labels map[string][]string, excludedNamespaces []string, excludedLabels map[string][]string) error {
+	if err := ValidatePatterns(namespaces...); err != nil {
+		return err
+	}
+	if err := ValidateLabelPatterns(labels); err != nil {
+		return err
+	}
+	if err := ValidatePatterns(excludedNamespaces...); err != nil {
+		return err
+	}
+	return ValidateLabelPatterns(excludedLabels)
+}
+
+// ValidateLabelPatterns checks that the regular expressions among the label values compile
+func ValidateLabelPatterns(labels map[string][]string) error {
+	for name, values := range labels {
+		if err := ValidatePatterns(values...); err != nil {
+			return fmt.Errorf("label %s: %w", name, err)
+		}
+	}
+	return nil
+}
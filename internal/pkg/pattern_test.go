@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestPattern_ToRegexp(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{"tenant-a", "tenant-a"},
+		{"team.a", `team\.a`},
+		{"a+(b)", `a\+\(b\)`},
+		{".*", `\.\*`},
+		{"~team-a-.*", "team-a-.*"},
+		{"~", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			if got := ToRegexp(tc.value); got != tc.expected {
+				t.Errorf("ToRegexp(%q) = %q, want %q", tc.value, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestPattern_JoinRegexps(t *testing.T) {
+	testCases := []struct {
+		values    []string
+		expected  string
+		matches   []string
+		unmatched []string
+	}{
+		{[]string{"team.a"}, `team\.a`, []string{"team.a"}, []string{"teamxa"}},
+		{[]string{"~team-.*"}, "team-.*", []string{"team-a"}, []string{"tenant-a"}},
+		{[]string{"a", "b.c"}, `a|b\.c`, []string{"a", "b.c"}, []string{"bxc"}},
+		{[]string{"~(?i)a", "b"}, "(?:(?i)a)|b", []string{"a", "A", "b"}, []string{"B"}},
+		{[]string{"~a|b", "c"}, "(?:a|b)|c", []string{"a", "b", "c"}, []string{"ab"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			got := JoinRegexps(tc.values...)
+			if got != tc.expected {
+				t.Errorf("JoinRegexps(%q) = %q, want %q", tc.values, got, tc.expected)
+			}
+			re := regexp.MustCompile("^(?:" + got + ")$")
+			for _, value := range tc.matches {
+				if !re.MatchString(value) {
+					t.Errorf("%q should match %q", got, value)
+				}
+			}
+			for _, value := range tc.unmatched {
+				if re.MatchString(value) {
+					t.Errorf("%q should not match %q", got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestPattern_ValidatePatterns(t *testing.T) {
+	testCases := []struct {
+		values  []string
+		wantErr bool
+	}{
+		{[]string{}, false},
+		{[]string{"a(b"}, false}, // literal values are never compiled
+		{[]string{"~team-.*", "tenant-a"}, false},
+		{[]string{"tenant-a", "~team-(a"}, true},
+		{[]string{"~(?i)team-a", "tenant-b"}, false},
+	}
+
+	for _, tc := range testCases {
+		if err := ValidatePatterns(tc.values...); (err != nil) != tc.wantErr {
+			t.Errorf("ValidatePatterns(%v) error = %v, wantErr %v", tc.values, err, tc.wantErr)
+		}
+	}
+}
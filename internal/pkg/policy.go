@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy Contains a list of rules granting access to users and groups
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule Grants namespaces, labels and endpoints to the listed users and to
+// the members of the listed groups
+type Rule struct {
+	Users      []string            `yaml:"users"`
+	Groups     []string            `yaml:"groups"`
+	Namespaces []string            `yaml:"namespaces"`
+	Labels     map[string][]string `yaml:"labels"`
+	Endpoints  []string            `yaml:"endpoints"`
+	Methods    []string            `yaml:"methods"`
+	// ExcludedNamespaces and ExcludedLabels hide series, even within the namespaces and labels above
+	ExcludedNamespaces []string            `yaml:"excludedNamespaces"`
+	ExcludedLabels     map[string][]string `yaml:"excludedLabels"`
+	// RateLimit limits the requests of the users, the most permissive limit applies if several rules match
+	RateLimit *RateLimit `yaml:"rateLimit"`
+	// QueryLimits restricts the queries of the users, the most permissive limits apply if several rules match
+	QueryLimits *QueryLimits `yaml:"queryLimits"`
+}
+
+// ParsePolicy read a policy file in the path `location` and returns a Policy object
+func ParsePolicy(location *string) (*Policy, error) {
+	file, err := os.Open(*location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	policy := Policy{}
+	err = yaml.NewDecoder(file).Decode(&policy)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range policy.Rules {
+		if len(policy.Rules[i].Users) == 0 && len(policy.Rules[i].Groups) == 0 {
+			return nil, fmt.Errorf("rule %d: at least one user or group is required", i)
+		}
+		rule := &policy.Rules[i]
+		if err := ValidateScope(rule.Namespaces, rule.Labels, rule.ExcludedNamespaces, rule.ExcludedLabels); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if err := rule.RateLimit.Validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if err := rule.QueryLimits.Validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if policy.Rules[i].Namespaces == nil {
+			policy.Rules[i].Namespaces = []string{}
+		}
+		if policy.Rules[i].Labels == nil {
+			policy.Rules[i].Labels = map[string][]string{}
+		}
+		if policy.Rules[i].Endpoints == nil {
+			policy.Rules[i].Endpoints = []string{}
+		}
+	}
+	return &policy, nil
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	policyInvalidLocation := "../../configs/no.config.yaml"
+	policyNoSubjectLocation := "../../configs/bad.policy.yaml"
+	policyLocation := "../../configs/policy.yaml"
+
+	expectedPolicy := Policy{
+		Rules: []Rule{
+			{
+				Groups:     []string{"team-a"},
+				Namespaces: []string{"tenant-a"},
+				Labels:     map[string][]string{},
+				Endpoints:  []string{},
+			}, {
+				Users:      []string{"alice"},
+				Groups:     []string{"sre"},
+				Namespaces: []string{"monitoring"},
+				Labels: map[string][]string{
+					"team": {"sre"},
+				},
+				Endpoints: []string{"/api/v1/query", "/api/v1/query_range"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		location *string
+		want     *Policy
+		wantErr  bool
+	}{
+		{"Policy", &policyLocation, &expectedPolicy, false},
+		{"Rule without users nor groups", &policyNoSubjectLocation, nil, true},
+		{"Invalid location", &policyInvalidLocation, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePolicy(tt.location)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePolicy() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}